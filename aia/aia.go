@@ -0,0 +1,329 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+// Package aia completes certificate chains that are missing intermediates by
+// fetching them from the caIssuers URLs in the certificates' Authority
+// Information Access extension, as browsers do.
+//
+// Fetched certificates are only used as candidate intermediates; chains are
+// still verified by rootcerts.Verify against the embedded roots, so a
+// malicious or broken URL can't cause a certificate to be trusted.
+package aia
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/internal/cms"
+)
+
+// Defaults for the Verifier limits.
+const (
+	DefaultMaxDepth = 4
+	DefaultTimeout  = 10 * time.Second
+	DefaultCacheTTL = time.Hour
+)
+
+// A Fetcher retrieves the certificates published at a caIssuers URL.
+type Fetcher interface {
+	Fetch(ctx context.Context, url string) ([]*x509.Certificate, error)
+}
+
+// FetcherFunc adapts a function to the Fetcher interface.
+type FetcherFunc func(ctx context.Context, url string) ([]*x509.Certificate, error)
+
+// Fetch calls f(ctx, url).
+func (f FetcherFunc) Fetch(ctx context.Context, url string) ([]*x509.Certificate, error) {
+	return f(ctx, url)
+}
+
+// HTTPFetcher fetches certificates over HTTP.  The response may hold a DER
+// certificate, a PKCS #7 certs-only bundle or PEM certificates.
+type HTTPFetcher struct {
+	Client  *http.Client // defaults to http.DefaultClient
+	MaxSize int64        // maximum response size; defaults to 1MB
+}
+
+// Fetch implements Fetcher.
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) ([]*x509.Certificate, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	maxSize := f.MaxSize
+	if maxSize <= 0 {
+		maxSize = 1 << 20
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxSize)
+	}
+	return ParseCertificates(data)
+}
+
+// ParseCertificates parses the formats used to publish issuer certificates:
+// a DER certificate, a PKCS #7 certs-only bundle or PEM certificates.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		var certs []*x509.Certificate
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "CERTIFICATE" {
+				continue
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return nil, errors.New("no certificates found")
+		}
+		return certs, nil
+	}
+	if cert, err := x509.ParseCertificate(data); err == nil {
+		return []*x509.Certificate{cert}, nil
+	}
+	sd, err := cms.Parse(data)
+	if err != nil {
+		return nil, errors.New("not a DER certificate, PKCS #7 bundle or PEM certificate")
+	}
+	if len(sd.Certificates) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return sd.Certificates, nil
+}
+
+type cacheEntry struct {
+	certs   []*x509.Certificate
+	expires time.Time
+}
+
+// A Verifier verifies certificates using rootcerts.Verify, fetching missing
+// intermediates when verification fails because a certificate's issuer is
+// unknown.  Fetched certificates are cached by URL.  A Verifier is safe for
+// concurrent use and its zero value is ready to use.
+type Verifier struct {
+	// Fetcher retrieves issuer certificates.  Defaults to an HTTPFetcher.
+	Fetcher Fetcher
+
+	// MaxDepth limits the number of successive issuers fetched for a chain.
+	// Defaults to DefaultMaxDepth.
+	MaxDepth int
+
+	// Timeout bounds the total time spent fetching for each verification.
+	// Defaults to DefaultTimeout.
+	Timeout time.Duration
+
+	// CacheTTL is how long fetched certificates are cached.  Defaults to
+	// DefaultCacheTTL.
+	CacheTTL time.Duration
+
+	verify rootcerts.VerifyFunc // rootcerts.Verify if nil
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+// Verify verifies leaf like rootcerts.Verify, but if no chain to a trusted
+// root can be built then the certificates at the caIssuers URLs of leaf and
+// its known issuers are fetched and verification is retried.
+func (v *Verifier) Verify(ctx context.Context, leaf *x509.Certificate, intermediates []*x509.Certificate, opts rootcerts.VerifyOptions) (*rootcerts.VerifyResult, error) {
+	verify := v.verify
+	if verify == nil {
+		verify = rootcerts.Verify
+	}
+	result, err := verify(leaf, intermediates, opts)
+	if err == nil || !isUnknownAuthority(err) {
+		return result, err
+	}
+
+	timeout := v.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	maxDepth := v.MaxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxDepth
+	}
+
+	pool := append([]*x509.Certificate{}, intermediates...)
+	visited := make(map[*x509.Certificate]bool)
+	frontier := []*x509.Certificate{leaf}
+	var fetchErr error
+	for depth := 0; depth < maxDepth && len(frontier) > 0; depth++ {
+		var fetched []*x509.Certificate
+		for len(frontier) > 0 {
+			cert := frontier[0]
+			frontier = frontier[1:]
+			if visited[cert] {
+				continue
+			}
+			visited[cert] = true
+			// follow known issuers until a certificate's issuer is missing
+			if issuers := findIssuers(cert, pool); len(issuers) > 0 {
+				frontier = append(frontier, issuers...)
+				continue
+			}
+			for _, u := range cert.IssuingCertificateURL {
+				certs, err := v.fetch(ctx, u)
+				if err != nil {
+					fetchErr = fmt.Errorf("fetching %s: %w", u, err)
+					continue
+				}
+				for _, c := range certs {
+					if !contains(pool, c) {
+						pool = append(pool, c)
+						fetched = append(fetched, c)
+					}
+				}
+			}
+		}
+		if len(fetched) == 0 {
+			break
+		}
+		if result, err = verify(leaf, pool, opts); err == nil || !isUnknownAuthority(err) {
+			return result, err
+		}
+		frontier = fetched
+	}
+	if fetchErr != nil {
+		return nil, fmt.Errorf("%w; %v", err, fetchErr)
+	}
+	return nil, err
+}
+
+// fetch returns the certificates at u from the cache, or fetches them.
+func (v *Verifier) fetch(ctx context.Context, u string) ([]*x509.Certificate, error) {
+	now := time.Now()
+	v.mu.Lock()
+	entry, ok := v.cache[u]
+	v.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.certs, nil
+	}
+
+	fetcher := v.Fetcher
+	if fetcher == nil {
+		fetcher = &HTTPFetcher{}
+	}
+	certs, err := fetcher.Fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	ttl := v.CacheTTL
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	v.mu.Lock()
+	if v.cache == nil {
+		v.cache = make(map[string]cacheEntry)
+	}
+	for k, e := range v.cache {
+		if now.After(e.expires) {
+			delete(v.cache, k)
+		}
+	}
+	v.cache[u] = cacheEntry{certs: certs, expires: now.Add(ttl)}
+	v.mu.Unlock()
+	return certs, nil
+}
+
+// TLSConfig returns a client tls.Config that verifies servers using v, so
+// that connections to servers that omit intermediates succeed.  Go's own
+// verification, which can't fetch intermediates, is disabled by setting
+// InsecureSkipVerify; the config must therefore be used unmodified, or with
+// VerifyConnection retained, for connections to remain secure.  opts.DNSName
+// must be set when dialing an IP address, as the connection then has no
+// server name to check.
+func (v *Verifier) TLSConfig(opts rootcerts.VerifyOptions) *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   v.VerifyConnection(opts),
+	}
+}
+
+// VerifyConnection returns a function suitable for tls.Config.VerifyConnection
+// that verifies the server's chain using v.  If opts.DNSName is empty then
+// the connection's server name is used, and if that is also empty the
+// connection is rejected, unless standard verification has already checked
+// the server's name.
+func (v *Verifier) VerifyConnection(opts rootcerts.VerifyOptions) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("aia: peer presented no certificates")
+		}
+		o := opts
+		if o.DNSName == "" {
+			o.DNSName = cs.ServerName
+		}
+		if o.DNSName == "" && len(cs.VerifiedChains) == 0 {
+			return errors.New("aia: no server name to verify; set VerifyOptions.DNSName")
+		}
+		_, err := v.Verify(context.Background(), cs.PeerCertificates[0], cs.PeerCertificates[1:], o)
+		return err
+	}
+}
+
+func isUnknownAuthority(err error) bool {
+	var uae x509.UnknownAuthorityError
+	return errors.As(err, &uae)
+}
+
+// findIssuers returns the certificates in pool whose subject is the issuer
+// of cert.
+func findIssuers(cert *x509.Certificate, pool []*x509.Certificate) []*x509.Certificate {
+	var issuers []*x509.Certificate
+	for _, c := range pool {
+		if bytes.Equal(c.RawSubject, cert.RawIssuer) && !c.Equal(cert) {
+			issuers = append(issuers, c)
+		}
+	}
+	return issuers
+}
+
+func contains(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
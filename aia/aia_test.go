@@ -0,0 +1,259 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package aia
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/internal/cms/cmstest"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+const (
+	testURL1 = "http://ca.example.com/intermediate1.crt"
+	testURL2 = "http://ca.example.com/intermediate2.crt"
+)
+
+// testPKI extends the shared test PKI, whose intermediate is the first of two,
+// with a second intermediate and a server certificate below it.  Each
+// certificate below the first intermediate names its issuer's URL.
+type testPKI struct {
+	*testpki.PKI
+	intermediate2, server *testpki.KeyPair
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	pki := &testPKI{PKI: testpki.New(t)}
+	tmpl := testpki.CATemplate("Test Intermediate 2")
+	tmpl.IssuingCertificateURL = []string{testURL1}
+	pki.intermediate2 = testpki.Issue(t, tmpl, pki.Intermediate)
+	tmpl = testpki.ServerTemplate("example.com", "example.com")
+	tmpl.IssuingCertificateURL = []string{testURL2}
+	pki.server = testpki.Issue(t, tmpl, pki.intermediate2)
+	return pki
+}
+
+// verifyChain verifies certificates against the test root in the way that
+// rootcerts.Verify would if the root were embedded.
+func (pki *testPKI) verifyChain(leaf *x509.Certificate, intermediates []*x509.Certificate, opts rootcerts.VerifyOptions) (*rootcerts.VerifyResult, error) {
+	chains, err := pki.Verify(leaf, intermediates, x509.VerifyOptions{
+		DNSName:   opts.DNSName,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &rootcerts.VerifyResult{
+		Chain:  chains[0],
+		Anchor: rootcerts.Cert{Label: "Test Root", Trust: rootcerts.ServerTrustedDelegator, DER: pki.Root.Cert.Raw},
+	}, nil
+}
+
+// testFetcher serves the test intermediates and counts requests.
+type testFetcher struct {
+	pki *testPKI
+
+	mu    sync.Mutex
+	count map[string]int
+}
+
+func (f *testFetcher) Fetch(ctx context.Context, url string) ([]*x509.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.count == nil {
+		f.count = make(map[string]int)
+	}
+	f.count[url]++
+	switch url {
+	case testURL1:
+		return []*x509.Certificate{f.pki.Intermediate.Cert}, nil
+	case testURL2:
+		return []*x509.Certificate{f.pki.intermediate2.Cert}, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (f *testFetcher) requests() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return fmt.Sprint(f.count[testURL1], f.count[testURL2])
+}
+
+func TestVerify(t *testing.T) {
+	pki := newTestPKI(t)
+	fetcher := &testFetcher{pki: pki}
+	v := &Verifier{Fetcher: fetcher, verify: pki.verifyChain}
+	ctx := context.Background()
+
+	result, err := v.Verify(ctx, pki.server.Cert, nil, rootcerts.VerifyOptions{DNSName: "example.com"})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(result.Chain) != 4 {
+		t.Errorf("Incorrect chain length %d", len(result.Chain))
+	}
+	if r := fetcher.requests(); r != "1 1" {
+		t.Errorf("Incorrect requests %s", r)
+	}
+
+	// the fetched certificates are cached
+	if _, err := v.Verify(ctx, pki.server.Cert, nil, rootcerts.VerifyOptions{}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if r := fetcher.requests(); r != "1 1" {
+		t.Errorf("Incorrect requests after caching %s", r)
+	}
+
+	// only the missing intermediate is fetched
+	fetcher = &testFetcher{pki: pki}
+	v = &Verifier{Fetcher: fetcher, verify: pki.verifyChain}
+	if _, err := v.Verify(ctx, pki.server.Cert, []*x509.Certificate{pki.intermediate2.Cert}, rootcerts.VerifyOptions{}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if r := fetcher.requests(); r != "1 0" {
+		t.Errorf("Incorrect requests with intermediate %s", r)
+	}
+
+	// other errors don't cause fetching
+	fetcher = &testFetcher{pki: pki}
+	v = &Verifier{Fetcher: fetcher, verify: pki.verifyChain}
+	if _, err := v.Verify(ctx, pki.server.Cert, []*x509.Certificate{pki.intermediate2.Cert, pki.Intermediate.Cert}, rootcerts.VerifyOptions{DNSName: "example.org"}); err == nil {
+		t.Error("Expected error")
+	}
+	if r := fetcher.requests(); r != "0 0" {
+		t.Errorf("Incorrect requests for name mismatch %s", r)
+	}
+}
+
+func TestVerifyLimits(t *testing.T) {
+	pki := newTestPKI(t)
+	ctx := context.Background()
+
+	v := &Verifier{Fetcher: &testFetcher{pki: pki}, MaxDepth: 1, verify: pki.verifyChain}
+	_, err := v.Verify(ctx, pki.server.Cert, nil, rootcerts.VerifyOptions{})
+	var uae x509.UnknownAuthorityError
+	if !errors.As(err, &uae) {
+		t.Errorf("Expected unknown authority error with depth 1, got %v", err)
+	}
+
+	blocking := FetcherFunc(func(ctx context.Context, url string) ([]*x509.Certificate, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	v = &Verifier{Fetcher: blocking, Timeout: 50 * time.Millisecond, verify: pki.verifyChain}
+	start := time.Now()
+	_, err = v.Verify(ctx, pki.server.Cert, nil, rootcerts.VerifyOptions{})
+	if !errors.As(err, &uae) || !strings.Contains(err.Error(), testURL2) {
+		t.Errorf("Expected unknown authority error naming the URL, got %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Timeout not applied, took %s", d)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	pki := newTestPKI(t)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	// the server omits its intermediates
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{pki.server.Cert.Raw},
+		PrivateKey:  pki.server.Key,
+	}}}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	v := &Verifier{Fetcher: &testFetcher{pki: pki}, verify: pki.verifyChain}
+	for _, test := range []struct {
+		name, dnsName string
+		ok            bool
+	}{
+		{"example.com", "", true},
+		{"example.org", "", false},
+		{"", "", false}, // dialing the IP address leaves nothing to check
+		{"", "example.com", true},
+	} {
+		config := v.TLSConfig(rootcerts.VerifyOptions{DNSName: test.dnsName})
+		config.ServerName = test.name
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if (err == nil) != test.ok {
+			t.Errorf("%q/%q: Unexpected result %v", test.name, test.dnsName, err)
+		}
+	}
+}
+
+func TestHTTPFetcher(t *testing.T) {
+	pki := newTestPKI(t)
+	p7 := cmstest.Sign(t, []byte("bundle"), pki.intermediate2, cmstest.Options{Certificates: []*x509.Certificate{pki.Intermediate.Cert}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/der":
+			w.Write(pki.Intermediate.Cert.Raw)
+		case "/pem":
+			pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: pki.Intermediate.Cert.Raw})
+		case "/p7c":
+			w.Write(p7)
+		case "/large":
+			w.Write(make([]byte, 8192))
+		case "/junk":
+			io.WriteString(w, "not a certificate")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	f := &HTTPFetcher{MaxSize: 4096}
+	for _, test := range []struct {
+		path  string
+		count int
+	}{
+		{"/der", 1},
+		{"/pem", 1},
+		{"/p7c", 2},
+		{"/large", 0},
+		{"/junk", 0},
+		{"/missing", 0},
+	} {
+		certs, err := f.Fetch(context.Background(), srv.URL+test.path)
+		if test.count == 0 {
+			if err == nil {
+				t.Errorf("%s: Expected error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", test.path, err)
+			continue
+		}
+		if len(certs) != test.count {
+			t.Errorf("%s: Incorrect certificate count %d", test.path, len(certs))
+		}
+	}
+
+	if _, err := f.Fetch(context.Background(), "ldap://ca.example.com/cn=issuer"); err == nil {
+		t.Error("Fetched unsupported URL")
+	}
+}
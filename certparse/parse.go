@@ -11,18 +11,27 @@ function which will parse objects into x509 certificates and return those that h
 been labeled as trusted as delegator in the certdata file (meaning they can be used by a CA
 to sign certificates).
 
+Certificates may also be read from alternative sources using ReadPEMCerts (a PEM bundle),
+ReadDERDir (a directory of DER encoded files) and ReadCCADBCSV (the CCADB included CA
+certificate report).  ReadSource selects one of these, or ReadTrustedCerts, by the name of
+its format.  WritePEM writes certificates as a PEM bundle that ReadPEMCerts reads back and
+WriteInventory writes a JSON inventory describing them.
+
 The certdata.txt file format changes occasionally, which may cause this parser to break.
 */
 package certparse
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -37,8 +46,21 @@ type Cert struct {
 	Data  []byte // Raw DER data
 	Trust TrustLevel
 	Cert  *x509.Certificate
+
+	// ServerDistrustAfter and EmailDistrustAfter, if not zero, hold the time
+	// after which certificates issued by this root are no longer trusted for
+	// the respective purpose.
+	ServerDistrustAfter time.Time
+	EmailDistrustAfter  time.Time
 }
 
+// Fingerprint returns the hex encoded SHA256 hash of the certificate's DER data.
+func (c Cert) Fingerprint() string {
+	sum := sha256.Sum256(c.Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// TrustLevel defines for which purposes a certificate is trusted to issue certificates.
 type TrustLevel int
 
 const (
@@ -293,16 +315,33 @@ func ReadTrustedCerts(f io.Reader) (certs []Cert, err error) {
 			continue
 		}
 
-		certs = append(certs, Cert{
+		c := Cert{
 			Label: obj["CKA_LABEL"],
 			Data:  []byte(obj["CKA_VALUE"]),
 			Cert:  cert,
 			Trust: trust,
-		})
+		}
+		if c.ServerDistrustAfter, err = parseDistrustAfter(obj["CKA_NSS_SERVER_DISTRUST_AFTER"]); err != nil {
+			return nil, fmt.Errorf("invalid server distrust after date for %q: %s", c.Label, err)
+		}
+		if c.EmailDistrustAfter, err = parseDistrustAfter(obj["CKA_NSS_EMAIL_DISTRUST_AFTER"]); err != nil {
+			return nil, fmt.Errorf("invalid email distrust after date for %q: %s", c.Label, err)
+		}
+		certs = append(certs, c)
 	}
 	return certs, nil
 }
 
+// parseDistrustAfter parses the value of a CKA_NSS_*_DISTRUST_AFTER field,
+// which is either CK_FALSE or a UTCTime such as "200630235959Z".  The zero
+// time is returned if the field is missing or false.
+func parseDistrustAfter(value string) (time.Time, error) {
+	if value == "" || value == "CK_FALSE" {
+		return time.Time{}, nil
+	}
+	return time.Parse("060102150405Z", value)
+}
+
 func findTrusted(objects []map[string]string) (map[string]TrustLevel, error) {
 	trusted := make(map[string]TrustLevel)
 	for _, obj := range objects {
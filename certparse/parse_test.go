@@ -8,7 +8,9 @@ import (
 	"bytes"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/kr/pretty"
 )
@@ -146,3 +148,35 @@ func TestReadTrustedCertsOk(t *testing.T) {
 	}
 
 }
+
+func TestReadTrustedCertsDistrustAfter(t *testing.T) {
+	label := "CKA_LABEL UTF8 \"Certinomis - Root CA\"\n"
+	input := strings.Replace(testCertInput, label, label+
+		"CKA_NSS_SERVER_DISTRUST_AFTER MULTILINE_OCTAL\n"+
+		"\\062\\060\\060\\066\\063\\060\\062\\063\\065\\071\\065\\071\\132\n"+
+		"END\n"+
+		"CKA_NSS_EMAIL_DISTRUST_AFTER CK_BBOOL CK_FALSE\n", 1)
+	certs, err := ReadTrustedCerts(strings.NewReader(input))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(certs) != 2 {
+		t.Fatal("Incorrect cert count", len(certs))
+	}
+
+	if !certs[0].ServerDistrustAfter.IsZero() || !certs[0].EmailDistrustAfter.IsZero() {
+		t.Errorf("Unexpected distrust dates for %q", certs[0].Label)
+	}
+	expected := time.Date(2020, 6, 30, 23, 59, 59, 0, time.UTC)
+	if !certs[1].ServerDistrustAfter.Equal(expected) {
+		t.Errorf("Incorrect server distrust date for %q: %s", certs[1].Label, certs[1].ServerDistrustAfter)
+	}
+	if !certs[1].EmailDistrustAfter.IsZero() {
+		t.Errorf("Unexpected email distrust date for %q", certs[1].Label)
+	}
+
+	bad := strings.Replace(testCertInput, label, label+"CKA_NSS_SERVER_DISTRUST_AFTER UTF8 \"tomorrow\"\n", 1)
+	if _, err := ReadTrustedCerts(strings.NewReader(bad)); err == nil {
+		t.Error("Invalid distrust date did not fail")
+	}
+}
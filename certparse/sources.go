@@ -0,0 +1,445 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package certparse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source formats accepted by ReadSource.
+const (
+	FormatCertdata = "certdata" // Mozilla's certdata.txt
+	FormatPEM      = "pem"      // a PEM bundle, as read by ReadPEMCerts
+	FormatDER      = "der"      // a directory of DER files, as read by ReadDERDir
+	FormatCCADB    = "ccadb"    // a CCADB CSV report, as read by ReadCCADBCSV
+)
+
+// ReadSource parses root certificates from f according to format, which is one
+// of the Format constants.  DER certificates are instead read from the
+// directory dir.  trust is applied to the pem and der formats, which carry no
+// trust information of their own.
+func ReadSource(format string, f io.Reader, dir string, trust TrustLevel) ([]Cert, error) {
+	switch format {
+	case FormatCertdata:
+		return ReadTrustedCerts(f)
+	case FormatPEM:
+		return ReadPEMCerts(f, trust)
+	case FormatCCADB:
+		return ReadCCADBCSV(f)
+	case FormatDER:
+		if dir == "" {
+			return nil, fmt.Errorf("the %s format requires a directory", FormatDER)
+		}
+		return ReadDERDir(dir, trust)
+	}
+	return nil, fmt.Errorf("unknown source format %q", format)
+}
+
+// ParseTrustLevel converts a comma separated list of trust purposes
+// ("server", "email" and "code") into a TrustLevel.
+func ParseTrustLevel(s string) (TrustLevel, error) {
+	var trust TrustLevel
+	for _, p := range strings.Split(s, ",") {
+		switch strings.ToLower(strings.TrimSpace(p)) {
+		case "server":
+			trust |= ServerTrustedDelegator
+		case "email":
+			trust |= EmailTrustedDelegator
+		case "code":
+			trust |= CodeTrustedDelegator
+		case "":
+		default:
+			return 0, fmt.Errorf("unknown trust purpose %q", p)
+		}
+	}
+	return trust, nil
+}
+
+// String returns the trust level as a comma separated list of purposes,
+// in the format accepted by ParseTrustLevel.
+func (t TrustLevel) String() string {
+	var purposes []string
+	if t&ServerTrustedDelegator != 0 {
+		purposes = append(purposes, "server")
+	}
+	if t&EmailTrustedDelegator != 0 {
+		purposes = append(purposes, "email")
+	}
+	if t&CodeTrustedDelegator != 0 {
+		purposes = append(purposes, "code")
+	}
+	return strings.Join(purposes, ",")
+}
+
+func newCert(label string, der []byte, trust TrustLevel) (Cert, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return Cert{}, err
+	}
+	if label == "" {
+		label = certLabel(cert)
+	}
+	return Cert{Label: label, Data: der, Trust: trust, Cert: cert}, nil
+}
+
+// certLabel derives a label for a certificate that has none from its subject.
+func certLabel(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		return cert.Subject.OrganizationalUnit[0]
+	}
+	return cert.Subject.String()
+}
+
+// ReadPEMCerts reads a bundle of PEM encoded certificates, such as those
+// produced by the Debian ca-certificates package, and returns them with the
+// supplied trust level.  Blocks other than CERTIFICATE are ignored.
+//
+// If a certificate is preceded by a title line underlined with '=' characters
+// (as used by curl's cacert.pem) then that title is used as its label, otherwise
+// the label is derived from the certificate's subject.
+func ReadPEMCerts(f io.Reader, trust TrustLevel) (certs []Cert, err error) {
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	for n := 1; ; n++ {
+		label := pemTitle(data)
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := newCert(label, block.Bytes, trust)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PEM block %d: %s", n, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// WritePEM writes certs as a PEM bundle, preceding each certificate with its
+// label underlined in the style of curl's cacert.pem so that ReadPEMCerts
+// restores the labels.
+func WritePEM(w io.Writer, certs []Cert) error {
+	var buf bytes.Buffer
+	for i, c := range certs {
+		if i > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "%s\n%s\n", c.Label, strings.Repeat("=", len(c.Label)))
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Data})
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Inventory is the JSON document written by WriteInventory, which describes a
+// set of certificates without their data.
+type Inventory struct {
+	Generated    *time.Time      `json:"generated,omitempty"`
+	SourceSHA256 string          `json:"source_sha256,omitempty"`
+	Revision     string          `json:"revision,omitempty"`
+	Certificates []InventoryCert `json:"certificates"`
+}
+
+// InventoryCert describes a single certificate in an Inventory.
+type InventoryCert struct {
+	Label               string     `json:"label"`
+	SHA256              string     `json:"sha256"`
+	Serial              string     `json:"serial"`
+	Subject             string     `json:"subject"`
+	NotBefore           time.Time  `json:"not_before"`
+	NotAfter            time.Time  `json:"not_after"`
+	Trust               []string   `json:"trust"`
+	KeyType             string     `json:"key_type"`
+	PermittedDNSDomains []string   `json:"permitted_dns_domains,omitempty"`
+	ServerDistrustAfter *time.Time `json:"server_distrust_after,omitempty"`
+	EmailDistrustAfter  *time.Time `json:"email_distrust_after,omitempty"`
+}
+
+// NewInventoryCert returns the inventory entry for c, whose name constraints,
+// if any, are given by permitted.
+func NewInventoryCert(c Cert, permitted []string) InventoryCert {
+	return InventoryCert{
+		Label:               c.Label,
+		SHA256:              c.Fingerprint(),
+		Serial:              c.Cert.SerialNumber.String(),
+		Subject:             c.Cert.Subject.String(),
+		NotBefore:           c.Cert.NotBefore.UTC(),
+		NotAfter:            c.Cert.NotAfter.UTC(),
+		Trust:               strings.Split(c.Trust.String(), ","),
+		KeyType:             KeyType(c.Cert),
+		PermittedDNSDomains: permitted,
+		ServerDistrustAfter: OptionalTime(c.ServerDistrustAfter),
+		EmailDistrustAfter:  OptionalTime(c.EmailDistrustAfter),
+	}
+}
+
+// WriteInventory writes inv as indented JSON.
+func WriteInventory(w io.Writer, inv Inventory) error {
+	if inv.Certificates == nil {
+		inv.Certificates = []InventoryCert{}
+	}
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// OptionalTime returns nil for the zero time so that it is omitted from an
+// Inventory, and t in UTC otherwise.
+func OptionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// KeyType describes the certificate's public key, eg. rsa-2048 or ecdsa-p384.
+func KeyType(cert *x509.Certificate) string {
+	switch k := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("rsa-%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ecdsa-" + strings.ToLower(strings.Replace(k.Curve.Params().Name, "-", "", 1))
+	case ed25519.PublicKey:
+		return "ed25519"
+	}
+	return "unknown"
+}
+
+// pemTitle returns the curl style title preceding the next PEM block in data, if any.
+func pemTitle(data []byte) string {
+	i := bytes.Index(data, []byte("-----BEGIN"))
+	if i < 0 {
+		return ""
+	}
+	var lines []string
+	s := bufio.NewScanner(bytes.NewReader(data[:i]))
+	for s.Scan() {
+		if line := strings.TrimSpace(s.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if n := len(lines); n >= 2 && strings.Trim(lines[n-1], "=") == "" {
+		return lines[n-2]
+	}
+	return ""
+}
+
+// derExtensions lists the file extensions read by ReadDERDir.
+var derExtensions = []string{".der", ".cer", ".crt"}
+
+// ReadDERDir reads DER encoded certificates from the files in dir that have
+// a .der, .cer or .crt extension and returns them, sorted by file name, with
+// the supplied trust level.  Labels are derived from each certificate's subject.
+func ReadDERDir(dir string, trust TrustLevel) ([]Cert, error) {
+	return readDERFS(os.DirFS(dir), trust)
+}
+
+func readDERFS(fsys fs.FS, trust TrustLevel) (certs []Cert, err error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !contains(strings.ToLower(path.Ext(entry.Name())), derExtensions) {
+			continue
+		}
+		der, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		cert, err := newCert("", der, trust)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", entry.Name(), err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// Column names used from the CCADB included CA certificate report.
+const (
+	ccadbNameColumn        = "Common Name or Certificate Name"
+	ccadbFingerprintColumn = "SHA-256 Fingerprint"
+	ccadbTrustColumn       = "Trust Bits"
+	ccadbPEMColumn         = "PEM Info"
+)
+
+// ccadbTrustBits maps the values of the CCADB Trust Bits column to trust levels.
+var ccadbTrustBits = map[string]TrustLevel{
+	"websites": ServerTrustedDelegator,
+	"email":    EmailTrustedDelegator,
+	"code":     CodeTrustedDelegator,
+}
+
+// ReadCCADBCSV parses the CCADB "included CA certificate" CSV report (with PEM
+// info) and returns the certificates that have at least one trust bit set.
+//
+// Trust is derived from the semicolon separated "Trust Bits" column, where
+// Websites, Email and Code map to ServerTrustedDelegator, EmailTrustedDelegator
+// and CodeTrustedDelegator respectively.
+func ReadCCADBCSV(f io.Reader) (certs []Cert, err error) {
+	err = readCCADB(f, []string{ccadbNameColumn, ccadbTrustColumn, ccadbPEMColumn}, func(field func(string) string) error {
+		var trust TrustLevel
+		for _, bit := range strings.Split(field(ccadbTrustColumn), ";") {
+			bit = strings.ToLower(strings.TrimSpace(bit))
+			if bit == "" {
+				continue
+			}
+			t, ok := ccadbTrustBits[bit]
+			if !ok {
+				return fmt.Errorf("unknown trust bit %q", bit)
+			}
+			trust |= t
+		}
+		if trust == 0 {
+			return nil
+		}
+		cert, err := ccadbCert(field, ccadbNameColumn, trust)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		return nil
+	})
+	return certs, err
+}
+
+// Column names used from the CCADB intermediate certificate report.
+const (
+	ccadbIntermediateNameColumn = "Certificate Name"
+	ccadbRevocationColumn       = "Revocation Status"
+)
+
+// ReadCCADBIntermediatesCSV parses the CCADB "all intermediate certificates"
+// CSV report (with PEM info) and returns the certificates with no trust level.
+// Certificates whose "Revocation Status" is anything other than "Not Revoked",
+// such as "Revoked" or "Parent Cert Revoked", are skipped.
+func ReadCCADBIntermediatesCSV(f io.Reader) (certs []Cert, err error) {
+	err = readCCADB(f, []string{ccadbIntermediateNameColumn, ccadbPEMColumn}, func(field func(string) string) error {
+		if status := strings.ToLower(field(ccadbRevocationColumn)); status != "" && status != "not revoked" {
+			return nil
+		}
+		cert, err := ccadbCert(field, ccadbIntermediateNameColumn, 0)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+		return nil
+	})
+	return certs, err
+}
+
+// readCCADB reads a CCADB CSV report, which must hold the required columns,
+// calling fn for each record with a function returning the trimmed value of a
+// named column.  Errors returned by fn are reported against the record's line.
+func readCCADB(f io.Reader, required []string, fn func(field func(string) string) error) error {
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read CCADB header: %s", err)
+	}
+	cols := make(map[string]int)
+	for i, name := range header {
+		cols[strings.TrimSpace(name)] = i
+	}
+	for _, name := range required {
+		if _, ok := cols[name]; !ok {
+			return fmt.Errorf("CCADB report is missing the %q column", name)
+		}
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line, _ := r.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := cols[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		if err := fn(field); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+	}
+}
+
+// ccadbCert parses the certificate in a CCADB record's PEM column, labelling
+// it with the value of nameColumn and checking it against any fingerprint.
+func ccadbCert(field func(string) string, nameColumn string, trust TrustLevel) (Cert, error) {
+	block, _ := pem.Decode([]byte(strings.Trim(field(ccadbPEMColumn), "'")))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return Cert{}, fmt.Errorf("no PEM certificate found")
+	}
+	cert, err := newCert(field(nameColumn), block.Bytes, trust)
+	if err != nil {
+		return Cert{}, err
+	}
+	if fp := field(ccadbFingerprintColumn); fp != "" {
+		if fp = strings.ToLower(strings.Replace(fp, ":", "", -1)); fp != cert.Fingerprint() {
+			return Cert{}, fmt.Errorf("SHA-256 fingerprint mismatch for %q", cert.Label)
+		}
+	}
+	return cert, nil
+}
+
+// CompareCerts compares the certificates in a and b that are trusted for all
+// purposes in trust, matching them by SHA256 fingerprint.  It returns those
+// present only in a and those present only in b.
+func CompareCerts(a, b []Cert, trust TrustLevel) (onlyA, onlyB []Cert) {
+	return certsMissingFrom(a, b, trust), certsMissingFrom(b, a, trust)
+}
+
+// certsMissingFrom returns the certificates in src with the given trust that are
+// not present in dst with the same trust.
+func certsMissingFrom(src, dst []Cert, trust TrustLevel) (missing []Cert) {
+	present := make(map[string]bool)
+	for _, c := range dst {
+		if c.Trust&trust == trust {
+			present[c.Fingerprint()] = true
+		}
+	}
+	for _, c := range src {
+		if c.Trust&trust == trust && !present[c.Fingerprint()] {
+			missing = append(missing, c)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+// Package codesign verifies detached signatures over software artifacts, such
+// as release downloads, against the roots trusted for code signing.
+//
+// A signature may be either a detached PKCS #7 (CMS) signature, which carries
+// the signer's certificates, or a raw signature accompanied by the signer's
+// certificate chain.  In both cases the signer's certificate must chain to a
+// root that rootcerts.Verify trusts for CodeTrustedDelegator and must permit
+// the code signing extended key usage.
+//
+// Mozilla does not currently mark any root as trusted for code signing, so the
+// roots must be added to the rootcerts package when it is generated, using a
+// gencerts overlay with "code" trust.
+package codesign
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/internal/cms"
+)
+
+// Options controls the checks made by VerifyPKCS7 and VerifySignature.
+type Options struct {
+	// VerifyOptions is used to verify the signer's certificate.  Its Trust
+	// field is ignored; certificates are always verified for
+	// CodeTrustedDelegator.
+	rootcerts.VerifyOptions
+
+	// SignatureAlgorithm is the algorithm of a raw signature passed to
+	// VerifySignature.  Defaults to SHA-256 with PKCS #1 v1.5 for RSA keys,
+	// ECDSA with SHA-256 for ECDSA keys and Ed25519 for Ed25519 keys.
+	SignatureAlgorithm x509.SignatureAlgorithm
+}
+
+// Result describes a signer whose signature and certificate were verified.
+type Result struct {
+	Certificate *x509.Certificate
+	SigningTime time.Time // the signing time claimed by a PKCS #7 signer, if any
+	Verified    *rootcerts.VerifyResult
+}
+
+// VerifyPKCS7 verifies a DER, BER or PEM encoded PKCS #7 signature over
+// artifact.  Every signer must have a valid signature and a certificate that
+// chains to a root trusted for code signing.
+func VerifyPKCS7(artifact, p7 []byte, opts Options) ([]Result, error) {
+	return verifyPKCS7(artifact, p7, opts, rootcerts.Verify)
+}
+
+func verifyPKCS7(artifact, p7 []byte, opts Options, verifyChain rootcerts.VerifyFunc) ([]Result, error) {
+	if artifact == nil {
+		artifact = []byte{}
+	}
+	sd, err := cms.Parse(p7)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := sd.Verify(artifact, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Result
+	for _, s := range signers {
+		var intermediates []*x509.Certificate
+		for _, cert := range sd.Certificates {
+			if !cert.Equal(s.Certificate) {
+				intermediates = append(intermediates, cert)
+			}
+		}
+		verified, err := verifyCertificate(s.Certificate, intermediates, opts, verifyChain)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, Result{
+			Certificate: s.Certificate,
+			SigningTime: s.SigningTime,
+			Verified:    verified,
+		})
+	}
+	return results, nil
+}
+
+// VerifySignature verifies a raw signature over artifact made with the key of
+// chain[0], the signer's certificate.  The remaining certificates in chain are
+// used as intermediates.
+func VerifySignature(artifact, sig []byte, chain []*x509.Certificate, opts Options) (*Result, error) {
+	return verifySignature(artifact, sig, chain, opts, rootcerts.Verify)
+}
+
+func verifySignature(artifact, sig []byte, chain []*x509.Certificate, opts Options, verifyChain rootcerts.VerifyFunc) (*Result, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("codesign: no signer certificate")
+	}
+	leaf := chain[0]
+	alg := opts.SignatureAlgorithm
+	if alg == x509.UnknownSignatureAlgorithm {
+		switch leaf.PublicKey.(type) {
+		case *rsa.PublicKey:
+			alg = x509.SHA256WithRSA
+		case *ecdsa.PublicKey:
+			alg = x509.ECDSAWithSHA256
+		case ed25519.PublicKey:
+			alg = x509.PureEd25519
+		default:
+			return nil, fmt.Errorf("codesign: unsupported public key type %T", leaf.PublicKey)
+		}
+	}
+	if err := leaf.CheckSignature(alg, artifact, sig); err != nil {
+		return nil, fmt.Errorf("codesign: invalid signature: %s", err)
+	}
+
+	verified, err := verifyCertificate(leaf, chain[1:], opts, verifyChain)
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Certificate: leaf, Verified: verified}, nil
+}
+
+func verifyCertificate(leaf *x509.Certificate, intermediates []*x509.Certificate, opts Options, verifyChain rootcerts.VerifyFunc) (*rootcerts.VerifyResult, error) {
+	vopts := opts.VerifyOptions
+	vopts.Trust = rootcerts.CodeTrustedDelegator
+	verified, err := verifyChain(leaf, intermediates, vopts)
+	if err != nil {
+		return nil, fmt.Errorf("codesign: signer certificate %q: %w", leaf.Subject.CommonName, err)
+	}
+	return verified, nil
+}
+
+// ParseChain parses a certificate chain held as concatenated PEM blocks or
+// DER certificates, as supplied to VerifySignature.
+func ParseChain(data []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	block, rest := pem.Decode(data)
+	if block == nil {
+		var err error
+		if chain, err = x509.ParseCertificates(data); err != nil {
+			return nil, err
+		}
+	}
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("codesign: no certificates found")
+	}
+	return chain, nil
+}
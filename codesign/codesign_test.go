@@ -0,0 +1,177 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package codesign
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/internal/cms/cmstest"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+// testVerifier returns a rootcerts.VerifyFunc that verifies certificates against
+// the test root in the way that rootcerts.Verify would if the root were
+// trusted for code signing.
+func testVerifier(pki *testpki.PKI) rootcerts.VerifyFunc {
+	return func(leaf *x509.Certificate, intermediates []*x509.Certificate, opts rootcerts.VerifyOptions) (*rootcerts.VerifyResult, error) {
+		if opts.Trust != rootcerts.CodeTrustedDelegator {
+			return nil, fmt.Errorf("incorrect trust %d", opts.Trust)
+		}
+		chains, err := pki.Verify(leaf, intermediates, x509.VerifyOptions{
+			CurrentTime: opts.CurrentTime,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rootcerts.VerifyResult{
+			Chain:  chains[0],
+			Anchor: rootcerts.Cert{Label: "Test Root", Trust: rootcerts.CodeTrustedDelegator, DER: pki.Root.Cert.Raw},
+		}, nil
+	}
+}
+
+func TestVerifyPKCS7(t *testing.T) {
+	pki := testpki.New(t)
+	ecSigner := testpki.Issue(t, testpki.LeafTemplate("EC Release Signer", x509.ExtKeyUsageCodeSigning), pki.Intermediate)
+	rsaSigner := testpki.IssueRSA(t, testpki.LeafTemplate("RSA Release Signer", x509.ExtKeyUsageCodeSigning), pki.Intermediate)
+	emailSigner := testpki.Issue(t, testpki.LeafTemplate("Email Signer", x509.ExtKeyUsageEmailProtection), pki.Intermediate)
+	chain := []*x509.Certificate{pki.Intermediate.Cert}
+	artifact := []byte("release-1.2.3.tar.gz contents")
+
+	tests := []struct {
+		name     string
+		signer   *testpki.KeyPair
+		certs    []*x509.Certificate
+		artifact []byte
+		ok       bool
+	}{
+		{"ecdsa", ecSigner, chain, artifact, true},
+		{"rsa", rsaSigner, chain, artifact, true},
+		{"tampered", ecSigner, chain, []byte("release-1.2.3.tar.gz c0ntents"), false},
+		{"missing intermediate", ecSigner, nil, artifact, false},
+		{"wrong key usage", emailSigner, chain, artifact, false},
+	}
+	for _, test := range tests {
+		p7 := cmstest.Sign(t, artifact, test.signer, cmstest.Options{Detached: true, Certificates: test.certs})
+		results, err := verifyPKCS7(test.artifact, p7, Options{}, testVerifier(pki))
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: Expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", test.name, err)
+			continue
+		}
+		if len(results) != 1 || !results[0].Certificate.Equal(test.signer.Cert) {
+			t.Errorf("%s: Incorrect results", test.name)
+		} else if results[0].Verified.Anchor.Label != "Test Root" {
+			t.Errorf("%s: Incorrect anchor %q", test.name, results[0].Verified.Anchor.Label)
+		}
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	pki := testpki.New(t)
+	ecSigner := testpki.Issue(t, testpki.LeafTemplate("EC Release Signer", x509.ExtKeyUsageCodeSigning), pki.Intermediate)
+	rsaSigner := testpki.IssueRSA(t, testpki.LeafTemplate("RSA Release Signer", x509.ExtKeyUsageCodeSigning), pki.Intermediate)
+	emailSigner := testpki.Issue(t, testpki.LeafTemplate("Email Signer", x509.ExtKeyUsageEmailProtection), pki.Intermediate)
+	artifact := []byte("release-1.2.3.tar.gz contents")
+	digest := sha256.Sum256(artifact)
+
+	sign := func(kp *testpki.KeyPair, opts crypto.SignerOpts) []byte {
+		sig, err := kp.Key.Sign(rand.Reader, digest[:], opts)
+		if err != nil {
+			t.Fatal("Failed to sign", err)
+		}
+		return sig
+	}
+	pss := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+
+	tests := []struct {
+		name     string
+		signer   *testpki.KeyPair
+		sig      []byte
+		alg      x509.SignatureAlgorithm
+		artifact []byte
+		ok       bool
+	}{
+		{"ecdsa", ecSigner, sign(ecSigner, crypto.SHA256), 0, artifact, true},
+		{"rsa", rsaSigner, sign(rsaSigner, crypto.SHA256), 0, artifact, true},
+		{"rsa pss", rsaSigner, sign(rsaSigner, pss), x509.SHA256WithRSAPSS, artifact, true},
+		{"rsa pss as pkcs1", rsaSigner, sign(rsaSigner, pss), 0, artifact, false},
+		{"tampered", ecSigner, sign(ecSigner, crypto.SHA256), 0, []byte("tampered"), false},
+		{"wrong signer", rsaSigner, sign(ecSigner, crypto.SHA256), 0, artifact, false},
+		{"wrong key usage", emailSigner, sign(emailSigner, crypto.SHA256), 0, artifact, false},
+	}
+	for _, test := range tests {
+		chain := []*x509.Certificate{test.signer.Cert, pki.Intermediate.Cert}
+		result, err := verifySignature(test.artifact, test.sig, chain, Options{SignatureAlgorithm: test.alg}, testVerifier(pki))
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: Expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", test.name, err)
+			continue
+		}
+		if !result.Certificate.Equal(test.signer.Cert) || len(result.Verified.Chain) != 3 {
+			t.Errorf("%s: Incorrect result", test.name)
+		}
+	}
+
+	if _, err := verifySignature(artifact, nil, nil, Options{}, testVerifier(pki)); err == nil {
+		t.Error("Verified without a chain")
+	}
+}
+
+func TestVerifyEmbedded(t *testing.T) {
+	// a certificate from a private CA must not be trusted by the embedded roots
+	pki := testpki.New(t)
+	signer := testpki.Issue(t, testpki.LeafTemplate("Release Signer", x509.ExtKeyUsageCodeSigning), pki.Intermediate)
+	p7 := cmstest.Sign(t, []byte("artifact"), signer, cmstest.Options{Detached: true, Certificates: []*x509.Certificate{pki.Intermediate.Cert}})
+	_, err := VerifyPKCS7([]byte("artifact"), p7, Options{})
+	var uae x509.UnknownAuthorityError
+	if !errors.As(err, &uae) {
+		t.Errorf("Expected unknown authority error, got %v", err)
+	}
+}
+
+func TestParseChain(t *testing.T) {
+	pki := testpki.New(t)
+	var pemChain, derChain []byte
+	for _, cert := range []*x509.Certificate{pki.Intermediate.Cert, pki.Root.Cert} {
+		pemChain = append(pemChain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		derChain = append(derChain, cert.Raw...)
+	}
+	for name, data := range map[string][]byte{"pem": pemChain, "der": derChain} {
+		chain, err := ParseChain(data)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", name, err)
+			continue
+		}
+		if len(chain) != 2 || !chain[0].Equal(pki.Intermediate.Cert) || !chain[1].Equal(pki.Root.Cert) {
+			t.Errorf("%s: Incorrect chain", name)
+		}
+	}
+	for _, data := range [][]byte{pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}), nil, []byte(" \n")} {
+		if _, err := ParseChain(data); err == nil {
+			t.Errorf("Parsed chain without certificates from %q", data)
+		}
+	}
+}
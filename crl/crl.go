@@ -0,0 +1,419 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+// Package crl checks certificate chains against locally supplied certificate
+// revocation lists, such as the lists that roots publish for the
+// intermediates they have issued.
+//
+// Each CRL must be issued by one of the embedded roots and is only accepted if
+// its signature verifies against that root.  A Checker holds the latest CRL
+// for each root, or for each scope where a root partitions its CRLs using
+// the issuing distribution point extension, and its Check method may be used
+// as the CheckChain policy of rootcerts.VerifyOptions:
+//
+//	checker := crl.NewChecker()
+//	if err := checker.AddFile("root-ca.crl"); err != nil {
+//		log.Fatal(err)
+//	}
+//	_, err := rootcerts.Verify(leaf, intermediates, rootcerts.VerifyOptions{CheckChain: checker.Check})
+//
+// Revocation is only checked for certificates issued directly by a root that
+// has a CRL; no CRLs are fetched.  Delta CRLs, indirect CRLs, CRLs limited to
+// some revocation reasons and CRLs with other critical extensions are
+// rejected, as they can't safely be applied as a complete list.
+package crl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+)
+
+var (
+	// ErrRevoked is wrapped by the error returned by Check for a chain holding
+	// a revoked certificate.
+	ErrRevoked = errors.New("certificate has been revoked")
+
+	// ErrStale is wrapped by the error returned by Check, if RequireCurrent is
+	// set, when the CRL covering a certificate is past its next update time.
+	ErrStale = errors.New("certificate revocation list is out of date")
+)
+
+// rereadInterval is the minimum time between attempts to read a newer CRL
+// from the file that a stale CRL was read from.
+const rereadInterval = time.Minute
+
+var (
+	oidDeltaCRLIndicator        = asn1.ObjectIdentifier{2, 5, 29, 27}
+	oidIssuingDistributionPoint = asn1.ObjectIdentifier{2, 5, 29, 28}
+)
+
+// issuingDistributionPoint is the ASN.1 form of the issuing distribution
+// point CRL extension (RFC 5280 section 5.2.5).
+type issuingDistributionPoint struct {
+	DistributionPoint          distributionPointName `asn1:"optional,tag:0"`
+	OnlyContainsUserCerts      bool                  `asn1:"optional,tag:1"`
+	OnlyContainsCACerts        bool                  `asn1:"optional,tag:2"`
+	OnlySomeReasons            asn1.BitString        `asn1:"optional,tag:3"`
+	IndirectCRL                bool                  `asn1:"optional,tag:4"`
+	OnlyContainsAttributeCerts bool                  `asn1:"optional,tag:5"`
+}
+
+type distributionPointName struct {
+	FullName     []asn1.RawValue  `asn1:"optional,tag:0"`
+	RelativeName pkix.RDNSequence `asn1:"optional,tag:1"`
+}
+
+// uriTag is the tag of the uniformResourceIdentifier GeneralName.
+const uriTag = 6
+
+// scope is the set of certificates that a CRL covers, as limited by its
+// issuing distribution point.  The zero scope covers every certificate
+// issued by the CRL's issuer.
+type scope struct {
+	onlyUser bool
+	onlyCA   bool
+	points   string // space separated distribution point URIs, if limited to those
+}
+
+// covers reports whether cert falls within s.
+func (s scope) covers(cert *x509.Certificate) bool {
+	if s.onlyUser && cert.IsCA || s.onlyCA && !cert.IsCA {
+		return false
+	}
+	if s.points == "" {
+		return true
+	}
+	for _, uri := range strings.Fields(s.points) {
+		for _, point := range cert.CRLDistributionPoints {
+			if point == uri {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listScope returns the scope of list, or an error if it can't be applied as
+// a complete list of the revoked certificates within that scope.
+func listScope(list *x509.RevocationList) (scope, error) {
+	var s scope
+	for _, ext := range list.Extensions {
+		switch {
+		case ext.Id.Equal(oidDeltaCRLIndicator):
+			return s, errors.New("delta CRLs are not supported")
+		case ext.Id.Equal(oidIssuingDistributionPoint):
+			var err error
+			if s, err = parseIDP(ext.Value); err != nil {
+				return s, err
+			}
+		case ext.Critical:
+			return s, fmt.Errorf("unsupported critical extension %s", ext.Id)
+		}
+	}
+	for _, r := range list.RevokedCertificateEntries {
+		for _, ext := range r.Extensions {
+			if ext.Critical {
+				return s, fmt.Errorf("unsupported critical extension %s in the entry for serial %s", ext.Id, r.SerialNumber)
+			}
+		}
+	}
+	return s, nil
+}
+
+// parseIDP returns the scope given by an issuing distribution point extension.
+func parseIDP(der []byte) (scope, error) {
+	var idp issuingDistributionPoint
+	if rest, err := asn1.Unmarshal(der, &idp); err != nil {
+		return scope{}, fmt.Errorf("invalid issuing distribution point: %s", err)
+	} else if len(rest) > 0 {
+		return scope{}, errors.New("invalid issuing distribution point: trailing data")
+	}
+	switch {
+	case idp.IndirectCRL:
+		return scope{}, errors.New("indirect CRLs are not supported")
+	case idp.OnlySomeReasons.BitLength > 0:
+		return scope{}, errors.New("CRLs limited to some revocation reasons are not supported")
+	case idp.OnlyContainsAttributeCerts:
+		return scope{}, errors.New("attribute certificate CRLs are not supported")
+	case len(idp.DistributionPoint.RelativeName) > 0:
+		return scope{}, errors.New("relative distribution point names are not supported")
+	}
+
+	var uris []string
+	for _, name := range idp.DistributionPoint.FullName {
+		if name.Class == asn1.ClassContextSpecific && name.Tag == uriTag {
+			uris = append(uris, string(name.Bytes))
+		}
+	}
+	if len(idp.DistributionPoint.FullName) > 0 && len(uris) == 0 {
+		return scope{}, errors.New("distribution points without a URI are not supported")
+	}
+	sort.Strings(uris)
+	return scope{
+		onlyUser: idp.OnlyContainsUserCerts,
+		onlyCA:   idp.OnlyContainsCACerts,
+		points:   strings.Join(uris, " "),
+	}, nil
+}
+
+// entry is a CRL accepted for a root.
+type entry struct {
+	list    *x509.RevocationList
+	scope   scope
+	revoked map[string]x509.RevocationListEntry // by serial number
+	path    string                              // file the CRL was read from, if any
+	reread  time.Time                           // time of the last attempt to read path again
+}
+
+// A Checker holds CRLs issued by the embedded roots and checks chains against
+// them.  A Checker is safe for concurrent use.
+type Checker struct {
+	// RequireCurrent causes Check to reject chains when the CRL covering one
+	// of their certificates is past its next update time and no newer CRL
+	// can be read.  Otherwise an out of date CRL is still applied, as any
+	// revocations it lists remain in effect.
+	RequireCurrent bool
+
+	roots []*x509.Certificate
+	now   func() time.Time
+
+	mu   sync.Mutex
+	crls map[[sha256.Size]byte][]*entry // by fingerprint of the issuing root, one per scope
+}
+
+// NewChecker returns a Checker that accepts CRLs issued by the embedded
+// roots.  It holds no CRLs until they are added.
+func NewChecker() *Checker {
+	return newChecker(rootcerts.Certs())
+}
+
+func newChecker(roots []rootcerts.Cert) *Checker {
+	c := &Checker{
+		now:  time.Now,
+		crls: make(map[[sha256.Size]byte][]*entry),
+	}
+	for i := range roots {
+		c.roots = append(c.roots, roots[i].X509Cert())
+	}
+	return c
+}
+
+// Add parses one or more CRLs, either DER encoded or PEM encoded as X509 CRL
+// blocks, and adds those whose signature verifies against an embedded root.
+// A CRL replaces any older CRL held for the same root and scope; an older CRL
+// than the one held is ignored.  An error is returned if any CRL can't be
+// parsed, wasn't issued by an embedded root or can't be applied as a complete
+// list, in which case none are added.
+func (c *Checker) Add(data []byte) error {
+	return c.add(data, "")
+}
+
+// AddFile adds the CRLs in the file path, as for Add.  Once a CRL read from a
+// file is past its next update time, Check reads the file again, at most once
+// a minute, in case it has since been replaced with a newer CRL.
+func (c *Checker) AddFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := c.add(data, path); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *Checker) add(data []byte, path string) error {
+	lists, err := parseCRLs(data)
+	if err != nil {
+		return err
+	}
+	type accepted struct {
+		fp [sha256.Size]byte
+		e  *entry
+	}
+	var entries []accepted
+	for _, list := range lists {
+		fps, err := c.issuers(list)
+		if err != nil {
+			return err
+		}
+		s, err := listScope(list)
+		if err != nil {
+			return fmt.Errorf("CRL for %s: %s", list.Issuer, err)
+		}
+		e := newEntry(list, s, path)
+		for _, fp := range fps {
+			entries = append(entries, accepted{fp, e})
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range entries {
+		c.crls[a.fp] = insert(c.crls[a.fp], a.e)
+	}
+	return nil
+}
+
+// insert returns held with e added, replacing any older CRL with the same
+// scope.  held is not modified, as it may be in use by Check.
+func insert(held []*entry, e *entry) []*entry {
+	for i, h := range held {
+		if h.scope != e.scope {
+			continue
+		}
+		if !newer(e.list, h.list) {
+			return held
+		}
+		updated := append([]*entry(nil), held...)
+		updated[i] = e
+		return updated
+	}
+	return append(held[:len(held):len(held)], e)
+}
+
+// parseCRLs parses a DER encoded CRL or a sequence of PEM encoded CRLs.
+func parseCRLs(data []byte) ([]*x509.RevocationList, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN")) {
+		list, err := x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.RevocationList{list}, nil
+	}
+	var lists []*x509.RevocationList
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		list, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("CRL %d: %s", len(lists)+1, err)
+		}
+		lists = append(lists, list)
+	}
+	if len(lists) == 0 {
+		return nil, errors.New("no CRLs found")
+	}
+	return lists, nil
+}
+
+// issuers returns the fingerprints of the roots that issued list, which are
+// those with its issuer's name whose key verifies its signature.  More than
+// one root may share a name and key, such as when a root is reissued.
+func (c *Checker) issuers(list *x509.RevocationList) ([][sha256.Size]byte, error) {
+	var fps [][sha256.Size]byte
+	var sigErr error
+	for _, root := range c.roots {
+		if !bytes.Equal(root.RawSubject, list.RawIssuer) {
+			continue
+		}
+		if err := list.CheckSignatureFrom(root); err != nil {
+			sigErr = err
+			continue
+		}
+		fps = append(fps, sha256.Sum256(root.Raw))
+	}
+	switch {
+	case len(fps) > 0:
+		return fps, nil
+	case sigErr != nil:
+		return nil, fmt.Errorf("CRL for %s: invalid signature: %s", list.Issuer, sigErr)
+	}
+	return nil, fmt.Errorf("CRL for %s was not issued by an embedded root", list.Issuer)
+}
+
+func newEntry(list *x509.RevocationList, s scope, path string) *entry {
+	e := &entry{list: list, scope: s, revoked: make(map[string]x509.RevocationListEntry), path: path}
+	for _, r := range list.RevokedCertificateEntries {
+		e.revoked[r.SerialNumber.String()] = r
+	}
+	return e
+}
+
+// newer reports whether a supersedes b, preferring the CRL number and
+// falling back to the time each was issued.
+func newer(a, b *x509.RevocationList) bool {
+	if a.Number != nil && b.Number != nil {
+		return a.Number.Cmp(b.Number) > 0
+	}
+	return a.ThisUpdate.After(b.ThisUpdate)
+}
+
+// Check returns an error if any certificate in chain, which runs from the leaf
+// to a root, is listed as revoked by a CRL held for its issuer that covers
+// it.  Its signature matches the CheckChain field of rootcerts.VerifyOptions.
+func (c *Checker) Check(chain []*x509.Certificate) error {
+	now := c.now()
+	for i := 0; i < len(chain)-1; i++ {
+		cert := chain[i]
+		entries, err := c.lookup(chain[i+1], cert, now)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if r, ok := e.revoked[cert.SerialNumber.String()]; ok {
+				return fmt.Errorf("%w: %s (serial %s) was revoked at %s", ErrRevoked,
+					cert.Subject, cert.SerialNumber, r.RevocationTime.UTC().Format(time.RFC3339))
+			}
+		}
+	}
+	return nil
+}
+
+// lookup returns the CRLs held for issuer whose scope covers cert.  A CRL
+// past its next update time is read again from its file, if it has one.
+func (c *Checker) lookup(issuer, cert *x509.Certificate, now time.Time) ([]*entry, error) {
+	fp := sha256.Sum256(issuer.Raw)
+	var reread []string
+	c.mu.Lock()
+	for _, e := range c.crls[fp] {
+		if e.scope.covers(cert) && stale(e.list, now) && e.path != "" && now.Sub(e.reread) >= rereadInterval {
+			e.reread = now
+			reread = append(reread, e.path)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, path := range reread {
+		// a failure leaves the held CRL in place, which is handled below
+		if data, err := os.ReadFile(path); err == nil {
+			c.add(data, path)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []*entry
+	for _, e := range c.crls[fp] {
+		if !e.scope.covers(cert) {
+			continue
+		}
+		if c.RequireCurrent && stale(e.list, now) {
+			return nil, fmt.Errorf("%w: CRL for %s was due to be updated at %s", ErrStale,
+				e.list.Issuer, e.list.NextUpdate.UTC().Format(time.RFC3339))
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// stale reports whether list is past its next update time.  A CRL without a
+// next update time is never stale.
+func stale(list *x509.RevocationList, now time.Time) bool {
+	return !list.NextUpdate.IsZero() && now.After(list.NextUpdate)
+}
@@ -0,0 +1,265 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package crl
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+// testPKI extends the shared test PKI with a second intermediate, which tests
+// revoke, and a leaf issued by it.
+type testPKI struct {
+	*testpki.PKI
+	revoked      *testpki.KeyPair
+	revokedChain []*x509.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	pki := &testPKI{PKI: testpki.New(t)}
+	pki.revoked = testpki.Issue(t, testpki.CATemplate("Revoked Intermediate"), pki.Root)
+	leaf := testpki.Issue(t, testpki.ServerTemplate("example.org", "example.org"), pki.revoked)
+	pki.revokedChain = []*x509.Certificate{leaf.Cert, pki.revoked.Cert, pki.Root.Cert}
+	return pki
+}
+
+func (pki *testPKI) checker() *Checker {
+	return newChecker([]rootcerts.Cert{{Label: "Test Root", Trust: rootcerts.ServerTrustedDelegator, DER: pki.Root.Cert.Raw}})
+}
+
+// testCRL returns a DER encoded CRL issued by issuer, valid for a day from
+// thisUpdate, that revokes the certificates in revoked.
+func testCRL(t *testing.T, issuer *testpki.KeyPair, number int64, thisUpdate time.Time, revoked ...*x509.Certificate) []byte {
+	return testExtCRL(t, issuer, nil, number, thisUpdate, revoked...)
+}
+
+// testExtCRL returns a CRL as for testCRL with the extensions in exts.
+func testExtCRL(t *testing.T, issuer *testpki.KeyPair, exts []pkix.Extension, number int64, thisUpdate time.Time, revoked ...*x509.Certificate) []byte {
+	tmpl := &x509.RevocationList{
+		Number:          big.NewInt(number),
+		ThisUpdate:      thisUpdate,
+		NextUpdate:      thisUpdate.Add(24 * time.Hour),
+		ExtraExtensions: exts,
+	}
+	for _, cert := range revoked {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: thisUpdate.Add(-time.Hour),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, tmpl, issuer.Cert, issuer.Key)
+	if err != nil {
+		t.Fatal("Failed to create CRL", err)
+	}
+	return der
+}
+
+// testIDP returns an issuing distribution point extension.
+func testIDP(t *testing.T, idp issuingDistributionPoint) pkix.Extension {
+	value, err := asn1.Marshal(idp)
+	if err != nil {
+		t.Fatal("Failed to marshal issuing distribution point", err)
+	}
+	return pkix.Extension{Id: oidIssuingDistributionPoint, Critical: true, Value: value}
+}
+
+// testURIs returns a distribution point name holding uris.
+func testURIs(uris ...string) distributionPointName {
+	var name distributionPointName
+	for _, uri := range uris {
+		name.FullName = append(name.FullName, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: uriTag, Bytes: []byte(uri)})
+	}
+	return name
+}
+
+func TestCheck(t *testing.T) {
+	pki := newTestPKI(t)
+	c := pki.checker()
+	if err := c.Check(pki.revokedChain); err != nil {
+		t.Error("Unexpected error without a CRL", err)
+	}
+
+	now := time.Now()
+	if err := c.Add(testCRL(t, pki.Root, 1, now, pki.revoked.Cert)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := c.Check(pki.Chain()); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	err := c.Check(pki.revokedChain)
+	if !errors.Is(err, ErrRevoked) {
+		t.Errorf("Revoked intermediate was accepted: %v", err)
+	}
+
+	// the error survives being wrapped by rootcerts.Verify
+	if pe := (&rootcerts.PolicyError{Err: err}); !errors.Is(pe, ErrRevoked) {
+		t.Error("PolicyError does not wrap ErrRevoked")
+	}
+
+	// an older CRL is ignored and a newer one replaces it
+	if err := c.Add(testCRL(t, pki.Root, 0, now.Add(-time.Hour))); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := c.Check(pki.revokedChain); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Older CRL replaced the current one: %v", err)
+	}
+	if err := c.Add(testCRL(t, pki.Root, 2, now)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := c.Check(pki.revokedChain); err != nil {
+		t.Errorf("Newer CRL did not replace the current one: %v", err)
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	pki := newTestPKI(t)
+	impostor := testpki.Issue(t, testpki.CATemplate("Test Root"), nil)
+	deltaIndicator, _ := asn1.Marshal(1)
+	ext := func(ext pkix.Extension) []byte {
+		return testExtCRL(t, pki.Root, []pkix.Extension{ext}, 2, time.Now())
+	}
+	tests := map[string][]byte{
+		"delta CRL":         ext(pkix.Extension{Id: oidDeltaCRLIndicator, Critical: true, Value: deltaIndicator}),
+		"indirect CRL":      ext(testIDP(t, issuingDistributionPoint{IndirectCRL: true})),
+		"some reasons":      ext(testIDP(t, issuingDistributionPoint{OnlySomeReasons: asn1.BitString{Bytes: []byte{0x40}, BitLength: 2}})),
+		"attribute certs":   ext(testIDP(t, issuingDistributionPoint{OnlyContainsAttributeCerts: true})),
+		"unknown critical":  ext(pkix.Extension{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Critical: true, Value: []byte{0x05, 0x00}}),
+		"invalid IDP":       ext(pkix.Extension{Id: oidIssuingDistributionPoint, Critical: true, Value: []byte{0x05, 0x00}}),
+		"untrusted issuer":  testCRL(t, pki.Intermediate, 1, time.Now()),
+		"invalid signature": testCRL(t, impostor, 1, time.Now()),
+		"junk":              []byte("not a CRL"),
+		"empty PEM":         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.Root.Cert.Raw}),
+		"one bad of two": append(
+			pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: testCRL(t, pki.Root, 1, time.Now(), pki.revoked.Cert)}),
+			pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: testCRL(t, impostor, 1, time.Now())})...),
+	}
+	for name, data := range tests {
+		c := pki.checker()
+		// a CRL that can't be applied mustn't replace a complete one
+		if err := c.Add(testCRL(t, pki.Root, 1, time.Now(), pki.revoked.Cert)); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if err := c.Add(data); err == nil {
+			t.Errorf("%s: Expected error", name)
+		}
+		if err := c.Check(pki.revokedChain); !errors.Is(err, ErrRevoked) {
+			t.Errorf("%s: CRL replaced the complete CRL: %v", name, err)
+		}
+
+		c = pki.checker()
+		if err := c.Add(data); err == nil {
+			t.Errorf("%s: Expected error", name)
+		}
+		if err := c.Check(pki.revokedChain); err != nil {
+			t.Errorf("%s: CRL was added despite the error: %v", name, err)
+		}
+	}
+}
+
+func TestNextUpdate(t *testing.T) {
+	pki := newTestPKI(t)
+	issued := time.Now().Add(-48 * time.Hour)
+	fn := filepath.Join(t.TempDir(), "root.crl")
+	data := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: testCRL(t, pki.Root, 1, issued, pki.revoked.Cert)})
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := pki.checker()
+	if err := c.AddFile(fn); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	// a stale CRL is still applied
+	if err := c.Check(pki.revokedChain); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Stale CRL was not applied: %v", err)
+	}
+	c.RequireCurrent = true
+	if err := c.Check(pki.Chain()); !errors.Is(err, ErrStale) {
+		t.Errorf("Stale CRL was accepted: %v", err)
+	}
+
+	// a newer CRL is read from the file, but no more than once a minute
+	data = testCRL(t, pki.Root, 2, time.Now())
+	if err := os.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Check(pki.Chain()); !errors.Is(err, ErrStale) {
+		t.Errorf("CRL file was read again too soon: %v", err)
+	}
+	c.now = func() time.Time { return time.Now().Add(2 * rereadInterval) }
+	if err := c.Check(pki.revokedChain); err != nil {
+		t.Errorf("Newer CRL was not read from the file: %v", err)
+	}
+	c.now = func() time.Time { return time.Now().Add(48 * time.Hour) }
+	if err := c.Check(pki.Chain()); !errors.Is(err, ErrStale) {
+		t.Errorf("Stale CRL was accepted: %v", err)
+	}
+}
+
+func TestScope(t *testing.T) {
+	pki := newTestPKI(t)
+	now := time.Now()
+	userOnly := testIDP(t, issuingDistributionPoint{OnlyContainsUserCerts: true})
+	caOnly := testIDP(t, issuingDistributionPoint{OnlyContainsCACerts: true})
+
+	// a CRL of end entity certificates doesn't cover the intermediate
+	c := pki.checker()
+	if err := c.Add(testExtCRL(t, pki.Root, []pkix.Extension{userOnly}, 1, now, pki.revoked.Cert)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := c.Check(pki.revokedChain); err != nil {
+		t.Errorf("CRL applied outside its scope: %v", err)
+	}
+	if err := c.Add(testExtCRL(t, pki.Root, []pkix.Extension{caOnly}, 1, now, pki.revoked.Cert)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := c.Check(pki.revokedChain); !errors.Is(err, ErrRevoked) {
+		t.Errorf("Revoked intermediate was accepted: %v", err)
+	}
+
+	// a newer CRL of a different scope doesn't replace the complete CRL
+	c = pki.checker()
+	if err := c.Add(testCRL(t, pki.Root, 1, now, pki.revoked.Cert)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := c.Add(testExtCRL(t, pki.Root, []pkix.Extension{userOnly}, 2, now)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := c.Check(pki.revokedChain); !errors.Is(err, ErrRevoked) {
+		t.Errorf("CRL of another scope replaced the complete CRL: %v", err)
+	}
+
+	// a partitioned CRL covers only certificates naming its distribution point
+	tmpl := testpki.CATemplate("Partitioned Intermediate")
+	tmpl.CRLDistributionPoints = []string{"http://crl.example.com/2.crl"}
+	partitioned := testpki.Issue(t, tmpl, pki.Root)
+	leaf := testpki.Issue(t, testpki.ServerTemplate("example.net", "example.net"), partitioned)
+	chain := []*x509.Certificate{leaf.Cert, partitioned.Cert, pki.Root.Cert}
+	c = pki.checker()
+	for i, uri := range []string{"http://crl.example.com/1.crl", "http://crl.example.com/2.crl"} {
+		idp := testIDP(t, issuingDistributionPoint{DistributionPoint: testURIs(uri)})
+		if err := c.Add(testExtCRL(t, pki.Root, []pkix.Extension{idp}, int64(i), now, partitioned.Cert, pki.revoked.Cert)); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if err := c.Check(pki.revokedChain); err != nil {
+			t.Errorf("%s: CRL applied outside its partition: %v", uri, err)
+		}
+		if err, revoked := c.Check(chain), i == 1; errors.Is(err, ErrRevoked) != revoked {
+			t.Errorf("%s: expected revoked=%t, got %v", uri, revoked, err)
+		}
+	}
+}
@@ -6,7 +6,8 @@
 Package rootcerts provides a Go conversion of Mozilla's certdata.txt
 file, extracting trusted CA certificates only.
 
-It was generated using the gencerts tool using the following command line:
+It is generated by running "go generate", which runs the gencerts tool using the
+settings found in gencerts.json, equivalent to the following command line:
     gencerts -download -target rootcerts.go -package rootcerts
 
 This package allows for the embedding of root CA certificates directly into
@@ -16,5 +17,22 @@ issued by those authorities.
 
 Root certificates can be accessed through this package, or may be easily installed
 into the http package's DefaultTransport by calling UpdateDefaultTransport.
+
+Verify checks a certificate chain against the roots trusted for a single purpose,
+applying Mozilla's name constraints and distrust after dates along with optional
+blocklist and custom policy checks, and reports the root that the chain ends at.
+TLSConfig and VerifyConnection apply the same checks to TLS client connections,
+while ClientAuthConfig and VerifyClientConnection apply them to the client
+certificates received by TLS servers.  If gencerts was run with -intermediates,
+the preloaded intermediates returned by Intermediates are used as candidates
+when building chains, so that servers which omit theirs can be verified.
+
+The smime package builds on Verify to check S/MIME signed messages against the
+roots trusted for email, while the codesign package checks signatures over
+release artifacts against the roots trusted for code signing.  The aia package
+fetches the intermediates that servers omit before verifying, as browsers do,
+and the crl package checks chains against locally supplied revocation lists.
 */
 package rootcerts
+
+//go:generate go run ./gencerts -config gencerts.json
@@ -0,0 +1,181 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// With -compress, certificates are emitted as a single flate compressed blob
+// rather than as individual byte slice literals.  Before compression each
+// certificate is encoded as a sequence of uvarint length prefixed fields:
+//
+//	label, serial, trust (a uvarint with no data), DER,
+//	domain count (a uvarint) followed by that many permitted DNS domains,
+//	server and email distrust after times (uvarint Unix times, 0 if unset)
+//
+// The generated decodeCerts function must be kept in sync with this format.
+
+// blobLineLen is the number of bytes of blob data quoted on each output line.
+const blobLineLen = 48
+
+var errTruncatedBlob = errors.New("truncated certificate data")
+
+// blobCert holds the fields of a single certificate stored in a blob.
+type blobCert struct {
+	Label   string
+	Serial  string
+	Trust   certparse.TrustLevel
+	DER     []byte
+	Domains []string
+
+	ServerDistrustAfter int64
+	EmailDistrustAfter  int64
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func putString(buf *bytes.Buffer, s string) {
+	putUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// encodeCerts returns the compressed blob representation of certs.
+func encodeCerts(certs []certparse.Cert, constraints map[string][]string) ([]byte, error) {
+	var raw bytes.Buffer
+	for _, c := range certs {
+		putString(&raw, c.Label)
+		putString(&raw, c.Cert.SerialNumber.String())
+		putUvarint(&raw, uint64(c.Trust))
+		putString(&raw, string(c.Data))
+		domains := constraints[c.Fingerprint()]
+		putUvarint(&raw, uint64(len(domains)))
+		for _, d := range domains {
+			putString(&raw, d)
+		}
+		putUvarint(&raw, uint64(unixTime(c.ServerDistrustAfter)))
+		putUvarint(&raw, uint64(unixTime(c.EmailDistrustAfter)))
+	}
+
+	var out bytes.Buffer
+	w, err := flate.NewWriter(&out, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// decodeCerts is the inverse of encodeCerts and mirrors the decoder emitted
+// into generated files.
+func decodeCerts(blob []byte) (result []blobCert, err error) {
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(blob)))
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	readUvarint := func() uint64 {
+		v, rerr := binary.ReadUvarint(r)
+		if rerr != nil && err == nil {
+			err = errTruncatedBlob
+		}
+		return v
+	}
+	readBytes := func() []byte {
+		n := readUvarint()
+		if err != nil || n > uint64(r.Len()) {
+			err = errTruncatedBlob
+			return nil
+		}
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+	for r.Len() > 0 && err == nil {
+		var c blobCert
+		c.Label = string(readBytes())
+		c.Serial = string(readBytes())
+		c.Trust = certparse.TrustLevel(readUvarint())
+		c.DER = readBytes()
+		for i, n := uint64(0), readUvarint(); i < n && err == nil; i++ {
+			c.Domains = append(c.Domains, string(readBytes()))
+		}
+		c.ServerDistrustAfter = int64(readUvarint())
+		c.EmailDistrustAfter = int64(readUvarint())
+		result = append(result, c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// unixTime returns t as a Unix time, or 0 if t is the zero time.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// quoteBlob formats data as a Go string constant expression split across lines.
+func quoteBlob(data []byte) string {
+	if len(data) == 0 {
+		return `""`
+	}
+	var lines []string
+	for len(data) > 0 {
+		n := blobLineLen
+		if n > len(data) {
+			n = len(data)
+		}
+		lines = append(lines, strconv.Quote(string(data[:n])))
+		data = data[n:]
+	}
+	return `"" +` + "\n\t" + strings.Join(lines, " +\n\t")
+}
+
+// blobConst is used by the template to emit the compressed certificate data.
+func blobConst(certs []certparse.Cert, constraints map[string][]string) (string, error) {
+	blob, err := encodeCerts(certs, constraints)
+	if err != nil {
+		return "", err
+	}
+	return quoteBlob(blob), nil
+}
+
+// reportCompression writes the size of the certificate data before and after
+// compression to stderr.
+func reportCompression(certs []certparse.Cert, constraints map[string][]string) {
+	var size int
+	for _, c := range certs {
+		size += len(c.Data)
+	}
+	blob, err := encodeCerts(certs, constraints)
+	if err != nil || size == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Compressed %d certificates from %d to %d bytes (%.1f%%)\n",
+		len(certs), size, len(blob), 100*float64(len(blob))/float64(size))
+}
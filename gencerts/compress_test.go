@@ -0,0 +1,172 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// embeddedCerts returns the certificates from the rootcerts package.
+func embeddedCerts(tb testing.TB) (certs []certparse.Cert) {
+	for _, c := range rootcerts.Certs() {
+		cert, err := x509.ParseCertificate(c.DER)
+		if err != nil {
+			tb.Fatal("Failed to parse certificate", err)
+		}
+		certs = append(certs, certparse.Cert{Label: c.Label, Data: c.DER, Trust: certparse.TrustLevel(c.Trust), Cert: cert})
+	}
+	return certs
+}
+
+func TestEncodeDecodeCerts(t *testing.T) {
+	certs := embeddedCerts(t)
+	constraints := map[string][]string{certs[1].Fingerprint(): {"example", "test"}}
+	certs[2].ServerDistrustAfter = time.Date(2020, 6, 30, 23, 59, 59, 0, time.UTC)
+	certs[3].EmailDistrustAfter = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	blob, err := encodeCerts(certs, constraints)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	decoded, err := decodeCerts(blob)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(decoded) != len(certs) {
+		t.Fatalf("Incorrect cert count expected=%d actual=%d", len(certs), len(decoded))
+	}
+	for i, c := range decoded {
+		if c.Label != certs[i].Label || c.Trust != certs[i].Trust || !bytes.Equal(c.DER, certs[i].Data) ||
+			c.Serial != certs[i].Cert.SerialNumber.String() {
+			t.Errorf("cert %d did not round trip", i)
+		}
+		if !reflect.DeepEqual(c.Domains, constraints[certs[i].Fingerprint()]) {
+			t.Errorf("cert %d incorrect domains %v", i, c.Domains)
+		}
+		if c.ServerDistrustAfter != unixTime(certs[i].ServerDistrustAfter) || c.EmailDistrustAfter != unixTime(certs[i].EmailDistrustAfter) {
+			t.Errorf("cert %d incorrect distrust dates %d %d", i, c.ServerDistrustAfter, c.EmailDistrustAfter)
+		}
+	}
+
+	if _, err := decodeCerts(blob[:len(blob)/2]); err == nil {
+		t.Error("Truncated blob did not fail")
+	}
+}
+
+func TestQuoteBlob(t *testing.T) {
+	data := []byte("\x00\xffé\"\\" + strings.Repeat("x", 100))
+	s := quoteBlob(data)
+	var result string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSuffix(strings.TrimSpace(line), " +")
+		part, err := strconv.Unquote(line)
+		if err != nil {
+			t.Fatalf("Failed to unquote %q: %s", line, err)
+		}
+		result += part
+	}
+	if result != string(data) {
+		t.Errorf("Quoted blob did not round trip")
+	}
+}
+
+// TestCompressedPackage builds and runs a program using a package generated
+// with -compress to ensure the generated decoder matches the encoder.
+func TestCompressedPackage(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping build of generated package in short mode")
+	}
+	dir := t.TempDir()
+	certs := embeddedCerts(t)
+	params := map[string]interface{}{
+		"package":     "rc",
+		"certs":       certs,
+		"time":        time.Now(),
+		"revision":    "test",
+		"constraints": map[string][]string{certs[0].Fingerprint(): {"example"}},
+		"compress":    true,
+	}
+	var out bytes.Buffer
+	if err := tpl.ExecuteTemplate(&out, "main", params); err != nil {
+		t.Fatal("Template execution failed", err)
+	}
+	files := map[string]string{
+		"go.mod":          "module example\n\ngo 1.22\n",
+		"rc/rootcerts.go": out.String(),
+		"main.go": `package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"example/rc"
+)
+
+func main() {
+	for _, c := range rc.Certs() {
+		fmt.Printf("%x %d %q %v\n", sha256.Sum256(c.DER), c.Trust, c.Label, c.PermittedDNSDomains)
+	}
+}
+`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	result, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run generated package: %s\n%s", err, result)
+	}
+
+	var expected bytes.Buffer
+	for i, c := range certs {
+		var domains []string
+		if i == 0 {
+			domains = []string{"example"}
+		}
+		fmt.Fprintf(&expected, "%s %d %q %v\n", c.Fingerprint(), c.Trust, c.Label, domains)
+	}
+	if string(result) != expected.String() {
+		t.Error("Generated package returned incorrect certificates")
+	}
+}
+
+func BenchmarkDecodeCerts(b *testing.B) {
+	certs := embeddedCerts(b)
+	blob, err := encodeCerts(certs, nil)
+	if err != nil {
+		b.Fatal("Unexpected error", err)
+	}
+	var size int
+	for _, c := range certs {
+		size += len(c.Data)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeCerts(blob); err != nil {
+			b.Fatal("Unexpected error", err)
+		}
+	}
+	b.ReportMetric(float64(size), "der-bytes")
+	b.ReportMetric(float64(len(blob)), "blob-bytes")
+}
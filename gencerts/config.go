@@ -0,0 +1,362 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// pathFlags lists the flags whose values are file or directory paths.  When
+// read from a config file, relative paths are resolved against the directory
+// holding the config file rather than the current directory.
+var pathFlags = map[string]bool{
+	"source":         true,
+	"target":         true,
+	"cache-dir":      true,
+	"constraints":    true,
+	"crosscheck":     true,
+	"sig":            true,
+	"pubkey":         true,
+	"template":       true,
+	"download-roots": true,
+	"intermediates":  true,
+}
+
+// config holds the structured settings read from a config file, in addition
+// to the flag settings that loadConfig applies directly.
+type config struct {
+	Sources     []sourceSpec
+	Overlays    []overlaySpec
+	Filters     filterSpec
+	Constraints map[string][]string
+	Outputs     []outputSpec
+}
+
+// sourceSpec describes a source of certificates.  Exactly one of Path or URL
+// is set; a Path of "" or "-" reads from stdin.
+type sourceSpec struct {
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	Format string `json:"format"`
+	Trust  string `json:"trust"`
+	SHA256 string `json:"expect_sha256"`
+	Sig    string `json:"sig"`
+	PubKey string `json:"pubkey"`
+}
+
+// overlaySpec describes a file of certificates that are added to those read
+// from the sources, replacing the trust of any that are already present.
+type overlaySpec struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	Trust  string `json:"trust"`
+}
+
+// filterSpec selects which of the certificates are written to the output.
+type filterSpec struct {
+	Purposes string   `json:"purposes"` // keep only certificates trusted for any of these
+	Exclude  []string `json:"exclude"`  // SHA256 fingerprints or labels to drop
+}
+
+// outputSpec describes a file to write.
+type outputSpec struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+}
+
+// configError reports an invalid setting, naming the key that holds it.
+type configError struct {
+	file string
+	key  string
+	err  error
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s: %s: %s", e.file, e.key, e.err)
+}
+
+// commandLineFlags returns the names of the flags in fs that were set on the
+// command line.  It must be called before loadConfig sets any flags.
+func commandLineFlags(fs *flag.FlagSet) map[string]bool {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	return explicit
+}
+
+// loadConfig reads a JSON object from path.  Keys that are flag names are
+// applied to any of those flags not in explicit, the flags set on the command
+// line; the remaining keys are validated and returned in a config.  If any
+// source flag is in explicit then none of the source flags are applied, so
+// that the config cannot, for example, turn a -source file into a download.
+func loadConfig(fs *flag.FlagSet, path string, explicit map[string]bool) (*config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var settings map[string]json.RawMessage
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	cfg := new(config)
+	sourceSet := explicitSource(explicit)
+
+	for name, raw := range settings {
+		var err error
+		switch {
+		case name == "sources":
+			err = decodeList(raw, &cfg.Sources, path, name)
+		case name == "overlays":
+			err = decodeList(raw, &cfg.Overlays, path, name)
+		case name == "outputs":
+			err = decodeList(raw, &cfg.Outputs, path, name)
+		case name == "filters":
+			err = decodeStrict(raw, &cfg.Filters)
+		case name == "constraints" && bytes.HasPrefix(bytes.TrimSpace(raw), []byte("{")):
+			// an object holds constraints inline, rather than naming a file
+			err = json.Unmarshal(raw, &cfg.Constraints)
+		case name == "output":
+			err = errors.New(`unknown key; use "outputs"`)
+		case fs.Lookup(name) == nil || name == "config":
+			err = errors.New("unknown key")
+		default:
+			err = setFlag(fs, name, raw, dir, explicit[name] || sourceSet && isSourceFlag(name))
+		}
+		if err != nil {
+			if _, ok := err.(*configError); ok {
+				return nil, err
+			}
+			return nil, &configError{path, name, err}
+		}
+	}
+
+	if err := cfg.validate(path, dir); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// configSources returns the sources in cfg, or nil if any source flag is in
+// explicit, the flags set on the command line.
+func configSources(cfg *config, explicit map[string]bool) []sourceSpec {
+	if explicitSource(explicit) {
+		return nil
+	}
+	return cfg.Sources
+}
+
+// explicitSource reports whether any source flag is in explicit.
+func explicitSource(explicit map[string]bool) bool {
+	for _, name := range sourceFlags {
+		if explicit[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// isSourceFlag reports whether name is one of sourceFlags.
+func isSourceFlag(name string) bool {
+	for _, n := range sourceFlags {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// configOutputs returns the outputs in cfg, or nil if -target or -output is in
+// explicit, the flags set on the command line.
+func configOutputs(cfg *config, explicit map[string]bool) []outputSpec {
+	if explicit["target"] || explicit["output"] {
+		return nil
+	}
+	return cfg.Outputs
+}
+
+// setFlag sets the flag name to the JSON value raw unless it was set on the
+// command line.
+func setFlag(fs *flag.FlagSet, name string, raw json.RawMessage, dir string, explicit bool) error {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return err
+	}
+	if explicit {
+		return nil
+	}
+
+	var s string
+	switch v := value.(type) {
+	case string:
+		s = v
+	case bool:
+		s = strconv.FormatBool(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return errors.New("must be a string, boolean or number")
+	}
+	if pathFlags[name] && !isBuiltinName(name, s) {
+		s = resolvePath(dir, s)
+	}
+	return fs.Set(name, s)
+}
+
+// decodeStrict decodes raw into v, rejecting any unknown fields.
+func decodeStrict(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// decodeList decodes a JSON array into the slice pointed to by v, reporting
+// errors against the index of the offending element.
+func decodeList[T any](raw json.RawMessage, v *[]T, file, key string) error {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err != nil {
+		return err
+	}
+	for i, elem := range elems {
+		var item T
+		if err := decodeStrict(elem, &item); err != nil {
+			return &configError{file, fmt.Sprintf("%s[%d]", key, i), err}
+		}
+		*v = append(*v, item)
+	}
+	return nil
+}
+
+// validate checks the structured settings and resolves any relative paths
+// against dir.
+func (cfg *config) validate(file, dir string) error {
+	keyErr := func(key string, format string, a ...interface{}) error {
+		return &configError{file, key, fmt.Errorf(format, a...)}
+	}
+
+	for i := range cfg.Sources {
+		s := &cfg.Sources[i]
+		key := fmt.Sprintf("sources[%d]", i)
+		if s.Format == "" {
+			s.Format = certparse.FormatCertdata
+		}
+		if s.Trust == "" {
+			s.Trust = "server"
+		}
+		if s.Path != "" && s.URL != "" {
+			return keyErr(key, "only one of path or url may be set")
+		}
+		if err := checkSource(file, key, s.Format, s.Trust); err != nil {
+			return err
+		}
+		if s.SHA256 != "" {
+			if s.SHA256 = normalizeFingerprint(s.SHA256); !isFingerprint(s.SHA256) {
+				return keyErr(key+".expect_sha256", "invalid SHA256 hash %q", s.SHA256)
+			}
+		}
+		if s.Sig != "" && s.PubKey == "" {
+			return keyErr(key+".pubkey", "required when sig is set")
+		}
+		if s.PubKey != "" && s.Sig == "" {
+			return keyErr(key+".sig", "required when pubkey is set")
+		}
+		s.Path = resolvePath(dir, s.Path)
+		s.Sig = resolvePath(dir, s.Sig)
+		s.PubKey = resolvePath(dir, s.PubKey)
+	}
+
+	for i := range cfg.Overlays {
+		o := &cfg.Overlays[i]
+		key := fmt.Sprintf("overlays[%d]", i)
+		if o.Format == "" {
+			o.Format = certparse.FormatPEM
+		}
+		if o.Trust == "" {
+			o.Trust = "server"
+		}
+		if o.Path == "" || o.Path == "-" {
+			return keyErr(key+".path", "must name a file")
+		}
+		if err := checkSource(file, key, o.Format, o.Trust); err != nil {
+			return err
+		}
+		o.Path = resolvePath(dir, o.Path)
+	}
+
+	if cfg.Filters.Purposes != "" {
+		if _, err := certparse.ParseTrustLevel(cfg.Filters.Purposes); err != nil {
+			return &configError{file, "filters.purposes", err}
+		}
+	}
+	for i, ex := range cfg.Filters.Exclude {
+		if ex == "" {
+			return keyErr(fmt.Sprintf("filters.exclude[%d]", i), "must be a fingerprint or label")
+		}
+	}
+
+	if err := mergeConstraints(make(map[string][]string), cfg.Constraints); err != nil {
+		return &configError{file, "constraints", err}
+	}
+
+	for i := range cfg.Outputs {
+		o := &cfg.Outputs[i]
+		key := fmt.Sprintf("outputs[%d]", i)
+		if o.Format == "" {
+			o.Format = outputGo
+		}
+		if !isOutputFormat(o.Format) {
+			return keyErr(key+".format", "unknown output format %q", o.Format)
+		}
+		if o.Path == "" {
+			return keyErr(key+".path", "must be set")
+		}
+		o.Path = resolvePath(dir, o.Path)
+	}
+	return nil
+}
+
+// checkSource validates the format and trust purpose list of the source or
+// overlay held by key.
+func checkSource(file, key, format, trust string) error {
+	switch format {
+	case certparse.FormatCertdata, certparse.FormatPEM, certparse.FormatDER, certparse.FormatCCADB:
+	default:
+		return &configError{file, key + ".format", fmt.Errorf("unknown source format %q", format)}
+	}
+	if _, err := certparse.ParseTrustLevel(trust); err != nil {
+		return &configError{file, key + ".trust", err}
+	}
+	return nil
+}
+
+// resolvePath joins a relative path to dir.  Empty paths and "-", which
+// stand for stdin or stdout, are returned unchanged.
+func resolvePath(dir, path string) string {
+	if path == "" || path == "-" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// isBuiltinName reports whether value is a keyword rather than a path for
+// a flag listed in pathFlags.
+func isBuiltinName(name, value string) bool {
+	switch name {
+	case "download-roots":
+		return value == rootsSystem || value == rootsEmbedded
+	case "template":
+		return value == defaultTemplate
+	}
+	return false
+}
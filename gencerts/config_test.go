@@ -0,0 +1,201 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("package", "main", "")
+	fs.String("source", "", "")
+	fs.String("target", "", "")
+	fs.String("download-roots", rootsSystem, "")
+	fs.Bool("download", false, "")
+	fs.String("url", "", "")
+	fs.Int("retries", 2, "")
+	return fs
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "gencerts.json")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"package": "fromconfig",
+		"source": "certdata.txt",
+		"target": "/abs/rootcerts.go",
+		"download-roots": "embedded",
+		"download": true,
+		"retries": 5
+	}`)
+	fs := testFlagSet()
+	if err := fs.Parse([]string{"-package", "fromflag"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(fs, path, commandLineFlags(fs)); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	expected := map[string]string{
+		"package":        "fromflag", // command line takes precedence
+		"source":         filepath.Join(filepath.Dir(path), "certdata.txt"),
+		"target":         "/abs/rootcerts.go",
+		"download-roots": "embedded",
+		"download":       "true",
+		"retries":        "5",
+	}
+	for name, value := range expected {
+		if actual := fs.Lookup(name).Value.String(); actual != value {
+			t.Errorf("flag %s expected=%q actual=%q", name, value, actual)
+		}
+	}
+}
+
+func TestLoadConfigStructured(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"sources": [
+			{"url": "https://example.com/certdata.txt", "expect_sha256": "AB:CD`+strings.Repeat("0", 60)+`"},
+			{"path": "extra.pem", "format": "pem", "trust": "server,email"}
+		],
+		"overlays": [{"path": "/etc/corp.pem"}],
+		"filters": {"purposes": "server", "exclude": ["Some Label"]},
+		"constraints": {"`+strings.Repeat("a", 64)+`": [".Example."]},
+		"outputs": [{"path": "out/rootcerts.go"}]
+	}`)
+	dir := filepath.Dir(path)
+	cfg, err := loadConfig(testFlagSet(), path, nil)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	expected := &config{
+		Sources: []sourceSpec{
+			{URL: "https://example.com/certdata.txt", Format: certparse.FormatCertdata, Trust: "server", SHA256: "abcd" + strings.Repeat("0", 60)},
+			{Path: filepath.Join(dir, "extra.pem"), Format: certparse.FormatPEM, Trust: "server,email"},
+		},
+		Overlays:    []overlaySpec{{Path: "/etc/corp.pem", Format: certparse.FormatPEM, Trust: "server"}},
+		Filters:     filterSpec{Purposes: "server", Exclude: []string{"Some Label"}},
+		Constraints: map[string][]string{strings.Repeat("a", 64): {"example"}},
+		Outputs:     []outputSpec{{Path: filepath.Join(dir, "out/rootcerts.go"), Format: outputGo}},
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Incorrect config\nexpected=%+v\nactual=  %+v", expected, cfg)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		key     string // key that the error must name
+	}{
+		{`{"sorce": "certdata.txt"}`, "sorce"},
+		{`{"source": ["a", "b"]}`, "source"},
+		{`{"retries": "many"}`, "retries"},
+		{`{"sources": {"path": "a"}}`, "sources"},
+		{`{"sources": [{"path": "a"}, {"path": "b", "fromat": "pem"}]}`, "sources[1]"},
+		{`{"sources": [{"path": "a", "format": "pom"}]}`, "sources[0].format"},
+		{`{"sources": [{"path": "a", "trust": "web"}]}`, "sources[0].trust"},
+		{`{"sources": [{"path": "a", "url": "https://example.com/"}]}`, "sources[0]"},
+		{`{"sources": [{"path": "a", "expect_sha256": "1234"}]}`, "sources[0].expect_sha256"},
+		{`{"sources": [{"path": "a", "sig": "a.sig"}]}`, "sources[0].pubkey"},
+		{`{"sources": [{"path": "a", "pubkey": "a.pub"}]}`, "sources[0].sig"},
+		{`{"overlays": [{"format": "der"}]}`, "overlays[0].path"},
+		{`{"filters": {"purposes": "web"}}`, "filters.purposes"},
+		{`{"filters": {"exclude": [""]}}`, "filters.exclude[0]"},
+		{`{"filters": {"include": ["x"]}}`, "filters"},
+		{`{"constraints": {"1234": ["example"]}}`, "constraints"},
+		{`{"outputs": [{"path": "a.go", "format": "yaml"}]}`, "outputs[0].format"},
+		{`{"outputs": [{"format": "go"}]}`, "outputs[0].path"},
+	}
+	for _, test := range tests {
+		path := writeTestConfig(t, test.content)
+		_, err := loadConfig(testFlagSet(), path, nil)
+		if err == nil {
+			t.Errorf("%s: did not receive an error", test.content)
+			continue
+		}
+		if prefix := path + ": " + test.key + ": "; !strings.HasPrefix(err.Error(), prefix) {
+			t.Errorf("%s: error %q does not name key %s", test.content, err, test.key)
+		}
+	}
+
+	if _, err := loadConfig(testFlagSet(), writeTestConfig(t, `source=certdata.txt`), nil); err == nil {
+		t.Error("Invalid JSON did not fail")
+	}
+}
+
+func TestConfigSourceFlags(t *testing.T) {
+	// a -source file is not replaced by the download the config asks for
+	path := writeTestConfig(t, `{"download": true, "url": "http://127.0.0.1:1/certdata.txt"}`)
+	for _, test := range []struct {
+		args          []string
+		download, url string
+	}{
+		{nil, "true", "http://127.0.0.1:1/certdata.txt"},
+		{[]string{"-source", "certdata.txt"}, "false", ""},
+	} {
+		fs := testFlagSet()
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(fs, path, commandLineFlags(fs)); err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if v := fs.Lookup("download").Value.String(); v != test.download {
+			t.Errorf("%v: incorrect download %s", test.args, v)
+		}
+		if v := fs.Lookup("url").Value.String(); v != test.url {
+			t.Errorf("%v: incorrect url %q", test.args, v)
+		}
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	// flags set by the config itself don't displace its structured keys
+	path := writeTestConfig(t, `{
+		"source": "certdata.txt",
+		"target": "rootcerts.go",
+		"sources": [{"path": "extra.pem", "format": "pem"}],
+		"outputs": [{"path": "out/rootcerts.go"}]
+	}`)
+	for _, test := range []struct {
+		args             []string
+		sources, outputs bool
+	}{
+		{nil, true, true},
+		{[]string{"-target", "other.go"}, true, false},
+		{[]string{"-source", "other.txt"}, false, true},
+	} {
+		fs := testFlagSet()
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		explicit := commandLineFlags(fs)
+		cfg, err := loadConfig(fs, path, explicit)
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		if sources := configSources(cfg, explicit) != nil; sources != test.sources {
+			t.Errorf("%v: expected config sources=%t", test.args, test.sources)
+		}
+		if outputs := configOutputs(cfg, explicit) != nil; outputs != test.outputs {
+			t.Errorf("%v: expected config outputs=%t", test.args, test.outputs)
+		}
+	}
+}
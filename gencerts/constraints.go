@@ -0,0 +1,85 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// defaultConstraints lists roots that Mozilla technically constrains to
+// specific DNS suffixes, keyed by their SHA256 fingerprint.
+var defaultConstraints = map[string][]string{
+	// TUBITAK Kamu SM SSL Kok Sertifikasi - Surum 1
+	"46edc3689046d53a453fb3104ab80dcaec658b2660ea1629dd7e867990648716": {"tr"},
+}
+
+// normalizeFingerprint converts a hex fingerprint to lower case and strips
+// any colon separators.
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(fp), ":", "", -1))
+}
+
+// isFingerprint reports whether fp is a normalized hex SHA256 fingerprint.
+func isFingerprint(fp string) bool {
+	if len(fp) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(fp)
+	return err == nil
+}
+
+// loadConstraints returns the default constraints merged with those read from
+// the JSON file at path, if any.  The file should contain an object mapping
+// SHA256 fingerprints to a list of permitted DNS suffixes; an empty list
+// removes a default constraint.
+func loadConstraints(path string) (map[string][]string, error) {
+	constraints := make(map[string][]string)
+	for fp, domains := range defaultConstraints {
+		constraints[fp] = domains
+	}
+	if path == "" {
+		return constraints, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var extra map[string][]string
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", path, err)
+	}
+	if err := mergeConstraints(constraints, extra); err != nil {
+		return nil, fmt.Errorf("%s in %s", err, path)
+	}
+	return constraints, nil
+}
+
+// mergeConstraints normalizes the entries of extra and merges them into
+// constraints, with an empty list removing an existing entry.
+func mergeConstraints(constraints, extra map[string][]string) error {
+	for fp, domains := range extra {
+		fp = normalizeFingerprint(fp)
+		if !isFingerprint(fp) {
+			return fmt.Errorf("invalid SHA256 fingerprint %q", fp)
+		}
+		if len(domains) == 0 {
+			delete(constraints, fp)
+			continue
+		}
+		for i, d := range domains {
+			domains[i] = strings.ToLower(strings.Trim(d, ". "))
+			if domains[i] == "" {
+				return fmt.Errorf("empty DNS suffix for %s", fp)
+			}
+		}
+		constraints[fp] = domains
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// crossCheck compares the server trusted certificates against those read from
+// the reference file at path and returns a report describing any differences.
+// The report is empty if both contain the same certificates.
+func crossCheck(certs []certparse.Cert, path, format string) (string, error) {
+	var (
+		f   *os.File
+		err error
+	)
+	if format != certparse.FormatDER {
+		if f, err = os.Open(path); err != nil {
+			return "", err
+		}
+		defer f.Close()
+	}
+	ref, err := readCerts(format, f, path, certparse.ServerTrustedDelegator, io.Discard)
+	if err != nil {
+		return "", fmt.Errorf("failed to read reference %s: %s", path, err)
+	}
+
+	onlySource, onlyRef := certparse.CompareCerts(certs, ref, certparse.ServerTrustedDelegator)
+	if len(onlySource) == 0 && len(onlyRef) == 0 {
+		return "", nil
+	}
+
+	var report bytes.Buffer
+	fmt.Fprintf(&report, "server trusted roots differ from %s reference %s:\n", format, path)
+	for _, c := range onlySource {
+		fmt.Fprintf(&report, "  only in source:    %s %q\n", c.Fingerprint(), c.Label)
+	}
+	for _, c := range onlyRef {
+		fmt.Fprintf(&report, "  only in reference: %s %q\n", c.Fingerprint(), c.Label)
+	}
+	return strings.TrimSuffix(report.String(), "\n"), nil
+}
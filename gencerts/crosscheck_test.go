@@ -0,0 +1,66 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+func TestCrossCheck(t *testing.T) {
+	shared := testCert(t, "Shared Root", certparse.ServerTrustedDelegator)
+	sourceOnly := testCert(t, "Source Root", certparse.ServerTrustedDelegator)
+	refOnly := testCert(t, "Reference Root", certparse.ServerTrustedDelegator)
+	email := testCert(t, "Email Root", certparse.EmailTrustedDelegator)
+	source := []certparse.Cert{shared, sourceOnly, email}
+	ref := []certparse.Cert{shared, refOnly}
+
+	var bundle bytes.Buffer
+	if err := certparse.WritePEM(&bundle, ref); err != nil {
+		t.Fatal(err)
+	}
+	pemPath := filepath.Join(t.TempDir(), "roots.pem")
+	if err := os.WriteFile(pemPath, bundle.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	derDir := t.TempDir()
+	for i, c := range ref {
+		if err := os.WriteFile(filepath.Join(derDir, fmt.Sprintf("%d.der", i)), c.Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct{ path, format string }{
+		{pemPath, certparse.FormatPEM},
+		{derDir, certparse.FormatDER},
+	} {
+		report, err := crossCheck(source, test.path, test.format)
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", test.format, err)
+			continue
+		}
+		expected := fmt.Sprintf("server trusted roots differ from %s reference %s:\n"+
+			"  only in source:    %s \"Source Root\"\n"+
+			"  only in reference: %s \"Reference Root\"",
+			test.format, test.path, sourceOnly.Fingerprint(), refOnly.Fingerprint())
+		if report != expected {
+			t.Errorf("%s: Incorrect report:\n%s\nexpected:\n%s", test.format, report, expected)
+		}
+
+		// the email root is not compared, so matching server roots agree
+		if report, err := crossCheck([]certparse.Cert{shared, refOnly, email}, test.path, test.format); err != nil || report != "" {
+			t.Errorf("%s: Unexpected report %q (err=%v)", test.format, report, err)
+		}
+	}
+
+	if _, err := crossCheck(source, filepath.Join(derDir, "missing.pem"), certparse.FormatPEM); err == nil {
+		t.Error("Did not receive an error for a missing reference")
+	}
+}
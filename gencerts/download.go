@@ -0,0 +1,253 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+)
+
+// errNotCached is returned by downloader.fetch in offline mode if the
+// requested url has not previously been cached.
+var errNotCached = errors.New("no cached copy available")
+
+// cacheMeta is stored alongside each cached download to allow for
+// conditional requests.
+type cacheMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// downloader fetches source data over HTTP, optionally caching responses in a
+// local directory keyed by url.  Cached copies are revalidated using the
+// ETag and Last-Modified headers returned by the server.
+type downloader struct {
+	client   *http.Client
+	cacheDir string        // disables caching if empty
+	retries  int           // number of additional attempts after a failed request
+	backoff  time.Duration // delay before the first retry; doubled for each subsequent retry
+	offline  bool          // only use the cache, never the network
+}
+
+func (d *downloader) cachePaths(url string) (data, meta string) {
+	sum := sha256.Sum256([]byte(url))
+	key := filepath.Join(d.cacheDir, hex.EncodeToString(sum[:]))
+	return key + ".data", key + ".json"
+}
+
+// readCache returns the cached data and metadata for url, if any.
+func (d *downloader) readCache(url string) ([]byte, *cacheMeta) {
+	if d.cacheDir == "" {
+		return nil, nil
+	}
+	dataPath, metaPath := d.cachePaths(url)
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return nil, nil
+	}
+	var meta cacheMeta
+	if mdata, err := os.ReadFile(metaPath); err == nil {
+		json.Unmarshal(mdata, &meta)
+	}
+	if meta.URL != url {
+		return nil, nil
+	}
+	return data, &meta
+}
+
+func (d *downloader) writeCache(url string, data []byte, meta *cacheMeta) error {
+	if err := os.MkdirAll(d.cacheDir, 0755); err != nil {
+		return err
+	}
+	mdata, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	dataPath, metaPath := d.cachePaths(url)
+	if err := writeFileAtomic(dataPath, data); err != nil {
+		return err
+	}
+	return writeFileAtomic(metaPath, mdata)
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path and then renames it into place.  The file keeps the permissions of
+// any existing file at path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := writeTemp(path, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// writeTemp writes data to a new temporary file in the same directory as path,
+// with the permissions of any existing file at path, and returns its name.
+func writeTemp(path string, data []byte) (string, error) {
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	err = f.Chmod(mode)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// syncDir flushes a rename in dir to disk.  Not all platforms support
+// syncing a directory, so errors are ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// fetch returns the content at url, using the cache where possible.
+func (d *downloader) fetch(url string) ([]byte, error) {
+	cached, meta := d.readCache(url)
+	if d.offline {
+		if cached == nil {
+			return nil, fmt.Errorf("%s: %w", url, errNotCached)
+		}
+		return cached, nil
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	backoff := d.backoff
+	for attempt := 0; attempt <= d.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var retry bool
+		if data, retry, err = d.get(url, cached, meta); err == nil || !retry {
+			break
+		}
+	}
+	return data, err
+}
+
+// get performs a single, possibly conditional, request for url.  It reports
+// whether a failed request may be retried.
+func (d *downloader) get(url string, cached []byte, meta *cacheMeta) (data []byte, retry bool, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if meta != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached, false, nil
+	case resp.StatusCode >= 500:
+		return nil, true, fmt.Errorf("non-200 status code: %s", resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, false, fmt.Errorf("non-200 status code: %s", resp.Status)
+	}
+
+	if data, err = io.ReadAll(resp.Body); err != nil {
+		return nil, true, err
+	}
+	if d.cacheDir != "" {
+		err = d.writeCache(url, data, &cacheMeta{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Fetched:      time.Now().UTC(),
+		})
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to update cache: %s", err)
+		}
+	}
+	return data, false, nil
+}
+
+// Values accepted by the -download-roots flag, in addition to a PEM file path.
+const (
+	rootsSystem   = "system"
+	rootsEmbedded = "embedded"
+)
+
+// downloadRoots returns the pool of root certificates the download client
+// should trust.  A nil pool indicates the system roots should be used.
+func downloadRoots(anchors string) (*x509.CertPool, error) {
+	switch anchors {
+	case rootsSystem, "":
+		return nil, nil
+	case rootsEmbedded:
+		return rootcerts.ServerCertPool(), nil
+	}
+	data, err := os.ReadFile(anchors)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", anchors)
+	}
+	return pool, nil
+}
+
+// newDownloadClient returns an HTTP client that trusts the roots selected by anchors.
+func newDownloadClient(anchors string, timeout time.Duration) (*http.Client, error) {
+	roots, err := downloadRoots(anchors)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
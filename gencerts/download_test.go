@@ -0,0 +1,144 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testETag = `"v1"`
+
+// newTestServer returns a server that supports ETag based conditional requests.
+// The first failures requests return a 503 status.
+func newTestServer(t *testing.T, failures int32) (*httptest.Server, *int32, *int32) {
+	var requests, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n := atomic.AddInt32(&requests, 1); n <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == testETag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", testETag)
+		w.Write([]byte("certdata"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests, &notModified
+}
+
+func TestDownloadCache(t *testing.T) {
+	srv, requests, notModified := newTestServer(t, 0)
+	d := &downloader{client: srv.Client(), cacheDir: t.TempDir()}
+
+	for i := 0; i < 2; i++ {
+		data, err := d.fetch(srv.URL)
+		if err != nil {
+			t.Fatalf("fetch %d: unexpected error: %s", i, err)
+		}
+		if string(data) != "certdata" {
+			t.Fatalf("fetch %d: incorrect data %q", i, data)
+		}
+	}
+	if *requests != 2 || *notModified != 1 {
+		t.Errorf("Expected a full and a conditional request, got requests=%d notModified=%d", *requests, *notModified)
+	}
+
+	d.offline = true
+	srv.Close()
+	data, err := d.fetch(srv.URL)
+	if err != nil || string(data) != "certdata" {
+		t.Errorf("Offline fetch failed data=%q err=%v", data, err)
+	}
+}
+
+func TestDownloadOfflineNotCached(t *testing.T) {
+	d := &downloader{client: http.DefaultClient, cacheDir: t.TempDir(), offline: true}
+	if _, err := d.fetch("http://example.invalid/certdata.txt"); !errors.Is(err, errNotCached) {
+		t.Fatalf("Did not receive expected error, got %v", err)
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	srv, requests, _ := newTestServer(t, 2)
+
+	d := &downloader{client: srv.Client(), retries: 1}
+	if _, err := d.fetch(srv.URL); err == nil {
+		t.Fatal("Expected failure with too few retries")
+	}
+
+	atomic.StoreInt32(requests, 0)
+	d.retries = 2
+	data, err := d.fetch(srv.URL)
+	if err != nil || string(data) != "certdata" {
+		t.Fatalf("Fetch failed data=%q err=%v", data, err)
+	}
+	if *requests != 3 {
+		t.Errorf("Incorrect request count %d", *requests)
+	}
+}
+
+func TestDownloadNotFound(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	d := &downloader{client: srv.Client(), retries: 3}
+	if _, err := d.fetch(srv.URL); err == nil {
+		t.Fatal("Did not receive an error")
+	}
+	if requests != 1 {
+		t.Errorf("Client errors should not be retried, got %d requests", requests)
+	}
+}
+
+func TestDownloadRoots(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("certdata"))
+	}))
+	defer srv.Close()
+
+	bundle := filepath.Join(t.TempDir(), "roots.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(bundle, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		anchors string
+		ok      bool
+	}{
+		{bundle, true},
+		{rootsEmbedded, false}, // test server's certificate isn't issued by a public CA
+	}
+	for _, test := range tests {
+		client, err := newDownloadClient(test.anchors, time.Minute)
+		if err != nil {
+			t.Fatalf("%s: failed to create client: %s", test.anchors, err)
+		}
+		d := &downloader{client: client}
+		data, err := d.fetch(srv.URL)
+		if ok := err == nil && string(data) == "certdata"; ok != test.ok {
+			t.Errorf("%s: expected ok=%t, got err=%v", test.anchors, test.ok, err)
+		}
+	}
+
+	if _, err := newDownloadClient(filepath.Join(t.TempDir(), "missing.pem"), time.Minute); err == nil {
+		t.Error("Expected error for missing PEM bundle")
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// mergeCerts appends to certs those of extra that it does not already hold.
+// Certificates present in both are trusted for the purposes of either.
+func mergeCerts(certs, extra []certparse.Cert) []certparse.Cert {
+	index := make(map[string]int)
+	for i, c := range certs {
+		index[c.Fingerprint()] = i
+	}
+	for _, c := range extra {
+		if i, ok := index[c.Fingerprint()]; ok {
+			certs[i].Trust |= c.Trust
+			continue
+		}
+		index[c.Fingerprint()] = len(certs)
+		certs = append(certs, c)
+	}
+	return certs
+}
+
+// applyOverlays adds the certificates read from each overlay to certs.  An
+// overlay certificate that is already present replaces the trust of the
+// existing copy rather than being added again.
+func applyOverlays(certs []certparse.Cert, overlays []overlaySpec) ([]certparse.Cert, error) {
+	for _, o := range overlays {
+		trust, err := certparse.ParseTrustLevel(o.Trust)
+		if err != nil {
+			return nil, err
+		}
+		var f *os.File
+		if o.Format != certparse.FormatDER {
+			if f, err = os.Open(o.Path); err != nil {
+				return nil, err
+			}
+		}
+		extra, err := readCerts(o.Format, f, o.Path, trust, io.Discard)
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", o.Path, err)
+		}
+
+		index := make(map[string]int)
+		for i, c := range certs {
+			index[c.Fingerprint()] = i
+		}
+		for _, c := range extra {
+			if i, ok := index[c.Fingerprint()]; ok {
+				certs[i].Trust = c.Trust
+			} else {
+				certs = append(certs, c)
+			}
+		}
+	}
+	return certs, nil
+}
+
+// applyFilters returns the certificates selected by f.
+func applyFilters(certs []certparse.Cert, f filterSpec) ([]certparse.Cert, error) {
+	purposes := allPurposes
+	if f.Purposes != "" {
+		var err error
+		if purposes, err = certparse.ParseTrustLevel(f.Purposes); err != nil {
+			return nil, err
+		}
+	}
+	exclude := make(map[string]bool)
+	for _, ex := range f.Exclude {
+		if fp := normalizeFingerprint(ex); isFingerprint(fp) {
+			ex = fp
+		}
+		exclude[ex] = true
+	}
+
+	var result []certparse.Cert
+	for _, c := range certs {
+		if c.Trust&purposes == 0 || exclude[c.Fingerprint()] || exclude[c.Label] {
+			continue
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
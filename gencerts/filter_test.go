@@ -0,0 +1,96 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// certSummary returns the label and trust of each certificate.
+func certSummary(certs []certparse.Cert) map[string]certparse.TrustLevel {
+	result := make(map[string]certparse.TrustLevel)
+	for _, c := range certs {
+		result[c.Label] = c.Trust
+	}
+	return result
+}
+
+func TestMergeCerts(t *testing.T) {
+	a := testCert(t, "a", certparse.ServerTrustedDelegator)
+	b := testCert(t, "b", certparse.EmailTrustedDelegator)
+	a2 := a
+	a2.Trust = certparse.CodeTrustedDelegator
+
+	certs := mergeCerts([]certparse.Cert{a}, []certparse.Cert{a2, b})
+	expected := map[string]certparse.TrustLevel{
+		"a": certparse.ServerTrustedDelegator | certparse.CodeTrustedDelegator,
+		"b": certparse.EmailTrustedDelegator,
+	}
+	if actual := certSummary(certs); len(certs) != 2 || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Incorrect merge %v", actual)
+	}
+}
+
+func TestApplyOverlays(t *testing.T) {
+	a := testCert(t, "a", certparse.ServerTrustedDelegator|certparse.EmailTrustedDelegator)
+	b := testCert(t, "b", certparse.ServerTrustedDelegator)
+	path := filepath.Join(t.TempDir(), "overlay.pem")
+	var data []byte
+	for _, c := range []certparse.Cert{a, b} {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Data})...)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := applyOverlays([]certparse.Cert{a}, []overlaySpec{{Path: path, Format: certparse.FormatPEM, Trust: "email"}})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(certs) != 2 {
+		t.Fatalf("Incorrect cert count %d", len(certs))
+	}
+	for _, c := range certs {
+		if c.Trust != certparse.EmailTrustedDelegator {
+			t.Errorf("%s has incorrect trust %s", c.Fingerprint(), c.Trust)
+		}
+	}
+}
+
+func TestApplyFilters(t *testing.T) {
+	certs := []certparse.Cert{
+		testCert(t, "server", certparse.ServerTrustedDelegator),
+		testCert(t, "email", certparse.EmailTrustedDelegator),
+		testCert(t, "both", certparse.ServerTrustedDelegator|certparse.EmailTrustedDelegator),
+		testCert(t, "excluded", certparse.ServerTrustedDelegator),
+	}
+	tests := []struct {
+		filter   filterSpec
+		expected []string
+	}{
+		{filterSpec{}, []string{"server", "email", "both", "excluded"}},
+		{filterSpec{Purposes: "server"}, []string{"server", "both", "excluded"}},
+		{filterSpec{Exclude: []string{"excluded", certs[1].Fingerprint()}}, []string{"server", "both"}},
+	}
+	for _, test := range tests {
+		result, err := applyFilters(certs, test.filter)
+		if err != nil {
+			t.Fatal("Unexpected error", err)
+		}
+		var labels []string
+		for _, c := range result {
+			labels = append(labels, c.Label)
+		}
+		if !reflect.DeepEqual(labels, test.expected) {
+			t.Errorf("filter %+v expected=%v actual=%v", test.filter, test.expected, labels)
+		}
+	}
+}
@@ -12,26 +12,160 @@ file are ignored.
 Without arguments, gencert reads a certdata.txt file from stdin and emits a .go file
 to stdout that contains the parsed certificates along with some helper methods to access them.
 
+By default the input is expected in certdata.txt format.  The -source-format option allows
+certificates to be read from a PEM bundle (pem), a directory of DER encoded files (der) or the
+CCADB included CA certificate CSV report (ccadb) instead.  PEM and DER sources carry no trust
+information, so their certificates are assigned the purposes listed by -source-trust.
+
 The program can also download the latest certdata.txt file from the Mozilla NSS Mercurial site
 (or another url using the -url option) or read and write to a specified filename using -source
 and -target.
 
+The generated file records the time it was generated, the SHA256 hash of the input and the
+revision passed with -revision.  If the SOURCE_DATE_EPOCH environment variable is set then it is
+used as the generation time instead of the current time.
+
+Roots that Mozilla constrains to particular DNS suffixes are emitted with their permitted domains
+so that the generated ServerCertPool rejects certificates for other names.  A built-in list of
+such roots may be extended using a JSON file supplied with -constraints.
+
+The server trusted roots may be compared against a second, independent source such as a PEM
+bundle or CCADB export using -crosscheck.  Any roots present in only one of the two are reported
+by fingerprint and cause the program to fail, or only warn if -crosscheck-warn is set.
+
+If -sig is given then the source data must carry a valid detached ed25519 signature from the
+public key supplied with -pubkey before it is parsed.  Signatures may be in minisign format
+(using its pure ed25519 algorithm) or raw ed25519 signatures.  The ID of the verifying key and
+a hash of the signature are recorded in the generated file's header.  Giving either of -sig
+and -pubkey without the other is an error.
+
+Downloads may be cached in a local directory using -cache-dir.  A cached copy is revalidated
+using a conditional request (If-None-Match/If-Modified-Since) and is used without contacting
+the server at all if -offline is set, allowing for fast and hermetic repeat runs.
+
+With -variants, certificates are written to separate files alongside -target, one for each
+combination of trust purposes, guarded by build tags.  Building with any of the tags
+rootcerts_server_only, rootcerts_email_only or rootcerts_code_only compiles in only those
+certificates trusted for the selected purposes; without them all certificates are included.
+
+With -compress, certificates are stored as a single flate compressed string constant that is
+decoded on first access rather than as individual byte slice literals, which reduces the size
+of binaries that include them.  The API of the generated package is unchanged.
+
+Intermediate certificates may be preloaded, as Firefox does, by naming a list of them with
+-intermediates.  The list is a PEM bundle or, with -intermediates-format ccadb, the CCADB
+intermediate certificate CSV report (with PEM info), from which revoked entries are skipped.
+Expired and non-CA certificates and any that are roots are dropped, and the remainder are written
+to a separate file alongside -target, named with an _intermediates suffix.  They confer no trust,
+but the generated Verify and TLS helpers use them as candidates when building chains.
+
+Several files may be written from a single run, so that they are all generated from the same
+source data, by repeating -output with a value of the form format=path.  The formats are go
+(the same output as -target), pem (a PEM bundle with curl style labels) and json (an inventory
+listing each certificate's label, fingerprint, serial number, subject, validity, trust purposes,
+key type and name constraints, as written by certparse.WriteInventory).  When -output is
+given, go output is only written if -target is also set.
+Every output is rendered before any is written, and each file is replaced atomically by writing
+to a temporary file; the temporary files are only renamed into place once all have been written,
+so an error never leaves a partially written file.  The set of outputs is not replaced
+atomically, however: if renaming one file fails, those renamed before it are already new.
+This applies to -target too: the source is parsed and the Go code rendered in memory, where it
+is checked with go/parser and formatted with go/format, before the existing file is replaced.
+Syntax errors in the generated code (eg. from a faulty -template) are reported with the
+offending lines and leave the existing file untouched.
+
+The generated code is also checked against the input: every DER literal (or compressed blob,
+with -compress) is decoded again and parsed, and the fingerprints and trust of the certificates
+found must exactly match those that were read.  Any certificate that is missing, unexpected,
+duplicated or has the wrong trust is reported and nothing is written.  A custom template that
+stores certificates in some other form should be used with -verify=false.
+
+Settings may also be read from a JSON file using -config, which makes gencerts convenient to
+drive from a //go:generate directive.  The file holds an object whose keys are flag names:
+
+	{
+	    "download": true,
+	    "package": "rootcerts",
+	    "target": "rootcerts.go"
+	}
+
+Relative paths in the file are resolved against the directory containing it and flags given
+on the command line take precedence over those in the file.  The file may also hold the
+following structured keys, which have no flag equivalent:
+
+	"sources"      a list of sources whose certificates are merged, each an object with a
+	               "path" or "url" and optional "format", "trust", "expect_sha256", "sig"
+	               and "pubkey" keys matching the flags of the same names
+	"overlays"     a list of objects with "path", "format" (pem by default) and "trust" keys
+	               naming extra certificates to add; any already present take the overlay's trust
+	"filters"      an object whose "purposes" key keeps only certificates trusted for any of
+	               the listed purposes and whose "exclude" key lists fingerprints or labels to drop
+	"constraints"  an object of name constraints in the same form as the -constraints file
+	"outputs"      a list of objects with "path" and "format" keys, as for -output
+
+Setting any source flag on the command line replaces "sources" and the source flags in the file,
+such as "download" and "url", and setting -target or -output replaces "outputs".  Errors in the file name the offending key, eg. "sources[1].format".  The SHA256
+hash of a single source may also be checked with -expect-sha256.
+
 NOTE: Using -download with an https url requires that the program have access to root certificates!
+By default the operating system's roots are used; set -download-roots to embedded to instead use
+the roots from the rootcerts package compiled into gencerts, or to the path of a PEM bundle.
 The certdata format used by the NSS project is also subject to intermittant change and may cause
 this program to fail.
+
+# Templates
+
+Output is generated using Go's text/template package.  The built-in template (named "default",
+found in the templates directory) defines the templates "main", which produces the -target
+file, "header", used at the top of every generated file, "certlist", which emits the elements
+of a []Cert literal, "variant", which produces each -variants file, and "intermediates", which
+produces the -intermediates file.
+
+A different template file may be supplied with -template.  It is parsed on top of the built-in
+definitions, so it may redefine only the templates it needs to change (for example supplying a
+"header" that adds a license comment).  If the file has any content outside of a {{define}}
+block then that content replaces "main".
+
+Templates are executed with a map holding the following keys:
+
+	.package      string                  package name given by -package
+	.certs        []certparse.Cert        certificates to emit (see below)
+	.time         time.Time               generation time
+	.filesha1     string                  hex encoded SHA1 hash of the input
+	.filesha256   string                  hex encoded SHA256 hash of the input
+	.revision     string                  value of -revision
+	.signature    *sigInfo                nil unless -sig was verified; has .KeyID and .Digest fields
+	.constraints  map[string][]string     permitted DNS suffixes keyed by certificate fingerprint
+	.variants     bool                    true if -variants is set
+	.compress     bool                    true if -compress is set
+
+Each certparse.Cert provides .Label, .Data (the DER encoded certificate), .Cert (the parsed
+*x509.Certificate), .Trust (a bitmask of 1 for server, 2 for email and 4 for code signing; use
+printf "%d" to emit it as a number), .ServerDistrustAfter and .EmailDistrustAfter (the time.Time
+after which Mozilla no longer trusts certificates issued by the root for that purpose, or the
+zero time) and .Fingerprint (the hex encoded SHA256 fingerprint of the certificate, which can be
+used with index to look up .constraints).
+
+When executing "intermediates", .certs holds the intermediates to preload.  When executing
+"variant", .certs holds only the certificates for that file, and the
+additional keys .buildtag, .varname and .purposes give the file's build constraint, the
+variable name to declare and the comma separated trust purposes it covers.
+
+Two functions are available in addition to the text/template builtins: indentbytes formats
+a []byte as an indented Go byte slice literal, and blob takes .certs and .constraints and
+returns a Go string constant expression holding the compressed form used by -compress.
 */
 package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"flag"
 	"fmt"
-	"hash"
 	"io"
-	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/gwatts/rootcerts/certparse"
@@ -41,12 +175,40 @@ const (
 	defaultDownloadURL = "https://hg.mozilla.org/releases/mozilla-release/raw-file/default/security/nss/lib/ckfw/builtins/certdata.txt"
 )
 
+var extraOutputs outputList
+
+func init() {
+	flag.Var(&extraOutputs, "output", "Additional output of the form format=path, where format is go, pem or json.  May be repeated")
+}
+
 var (
-	packageName = flag.String("package", "main", "Name of the package to use for generated file")
-	download    = flag.Bool("download", false, "Set to true to download the latest certificate data from Mozilla. See -url")
-	downloadURL = flag.String("url", defaultDownloadURL, "URL to download certificate data from if -download is true")
-	sourceFile  = flag.String("source", "", "Source filename to read certificate data from if -download is false.  Defaults to stdin")
-	outputFile  = flag.String("target", "", "Filename to write .go output file to.  Defaults to stdout")
+	packageName  = flag.String("package", "main", "Name of the package to use for generated file")
+	download     = flag.Bool("download", false, "Set to true to download the latest certificate data from Mozilla. See -url")
+	downloadURL  = flag.String("url", defaultDownloadURL, "URL to download certificate data from if -download is true")
+	cacheDir     = flag.String("cache-dir", "", "Directory to cache downloads in.  Cached copies are revalidated with conditional requests")
+	offline      = flag.Bool("offline", false, "Use the copy in -cache-dir rather than downloading if -download is true")
+	timeout      = flag.Duration("timeout", time.Minute, "Timeout for each download request")
+	retries      = flag.Int("retries", 2, "Number of times to retry a failed download")
+	dlRoots      = flag.String("download-roots", rootsSystem, "Root certificates trusted when downloading: system, embedded (those compiled into gencerts) or the path to a PEM bundle")
+	sourceFile   = flag.String("source", "", "Source filename to read certificate data from if -download is false.  Defaults to stdin")
+	sourceFmt    = flag.String("source-format", certparse.FormatCertdata, "Format of the source data: certdata, pem, der (a directory of files) or ccadb (CCADB CSV report)")
+	sourceTrust  = flag.String("source-trust", "server", "Comma separated trust purposes (server, email, code) to assign to pem and der sources")
+	outputFile   = flag.String("target", "", "Filename to write .go output file to.  Defaults to stdout")
+	revision     = flag.String("revision", "", "Source revision (eg. an NSS release tag) to record in the generated file")
+	crossRef     = flag.String("crosscheck", "", "Reference file (or directory) to compare the server trusted roots against")
+	crossFmt     = flag.String("crosscheck-format", certparse.FormatPEM, "Format of the -crosscheck reference; accepts the same values as -source-format")
+	crossWarn    = flag.Bool("crosscheck-warn", false, "Only warn, rather than fail, if -crosscheck finds differences")
+	expectSHA    = flag.String("expect-sha256", "", "Fail unless the source data has this SHA256 hash")
+	sigFile      = flag.String("sig", "", "Detached ed25519 or minisign signature file to verify the source data against before parsing")
+	pubKeyFile   = flag.String("pubkey", "", "Public key file (minisign format or base64 encoded ed25519 key) used to verify -sig")
+	variants     = flag.Bool("variants", false, "Write certificates to build tag guarded files alongside -target, one per combination of trust purposes")
+	compress     = flag.Bool("compress", false, "Store certificates as a single compressed blob that is decoded on first use, reducing binary size")
+	verifyOutput = flag.Bool("verify", true, "Check that the generated Go code holds exactly the input certificates before writing it")
+	configFile   = flag.String("config", "", "JSON file of flag settings; flags given on the command line take precedence")
+	tplFile      = flag.String("template", defaultTemplate, "Template file used to generate output, overlaid on the built-in default template")
+	constraints  = flag.String("constraints", "", "JSON file mapping root SHA256 fingerprints to permitted DNS suffixes, merged with the defaults")
+	interFile    = flag.String("intermediates", "", "File of intermediate certificates to preload as chain building candidates, written alongside -target")
+	interFmt     = flag.String("intermediates-format", certparse.FormatPEM, "Format of -intermediates: pem or ccadb (CCADB intermediate certificate CSV report)")
 )
 
 const (
@@ -54,115 +216,6 @@ const (
 	indentWrap = 64
 )
 
-var tplText = `{{define "main"}}package {{.package}}
-
-// Generated using github.com/gwatts/rootcerts/gencert
-// Generated on {{ .time }}
-// Input file SHA1: {{ .filesha1 }}
-
-import (
-	"crypto/tls"
-	"crypto/x509"
-	"errors"
-	"fmt"
-	"net/http"
-	"sync"
-)
-
-// TrustLevel defines for which purposes the certificate is trusted to issue
-// certificates (ie. to act as a CA)
-type TrustLevel int
-
-const (
-	ServerTrustedDelegator TrustLevel = 1 << iota // Trusted for issuing server certificates
-	EmailTrustedDelegator                         // Trusted for issuing email certificates
-	CodeTrustedDelegator                          // Trusted for issuing code signing certificates
-)
-
-// A Cert defines a single unparsed certificate.
-type Cert struct {
-	Label  string
-	Serial string
-	Trust  TrustLevel
-	DER    []byte
-}
-
-// X509Cert parses the certificate into a *x509.Certificate.
-func (c *Cert) X509Cert() *x509.Certificate {
-	cert, err := x509.ParseCertificate(c.DER)
-	if err != nil {
-		panic(fmt.Sprintf("unexpected failure parsing certificate %q/%s: %s", c.Label, c.Serial, err))
-	}
-	return cert
-}
-
-var serverCertPool *x509.CertPool
-var serverOnce sync.Once
-
-// ServerCertPool returns a pool containing all root CA certificates that are trusted
-// for issuing server certificates.
-func ServerCertPool() *x509.CertPool {
-	serverOnce.Do(func() {
-		serverCertPool = x509.NewCertPool()
-		for _, c := range CertsByTrust(ServerTrustedDelegator) {
-			serverCertPool.AddCert(c.X509Cert())
-		}
-	})
-	return serverCertPool
-}
-
-// CertsByTrust returns only those certificates that match all bits of
-// the specified TrustLevel.
-func CertsByTrust(t TrustLevel) (result []Cert) {
-	for _, c := range certs {
-		if c.Trust&t == t {
-			result = append(result, c)
-		}
-	}
-	return result
-}
-
-// UpdateDefaultTransport updates the configuration for http.DefaultTransport
-// to use the root CA certificates defined here when used as an HTTP client.
-//
-// It will return an error if the DefaultTransport is not actually an *http.Transport.
-func UpdateDefaultTransport() error {
-	if t, ok := http.DefaultTransport.(*http.Transport); ok {
-		if t.TLSClientConfig == nil {
-			t.TLSClientConfig = &tls.Config{RootCAs: ServerCertPool()}
-		} else {
-			t.TLSClientConfig.RootCAs = ServerCertPool()
-		}
-	} else {
-		return errors.New("http.DefaultTransport is not an *http.Transport")
-	}
-	return nil
-}
-
-// Certs returns all trusted certificates extracted from certdata.txt.
-func Certs() []Cert {
-	return certs
-}
-
-// make this unexported to avoid generating a huge documentation page.
-var certs = []Cert{
-{{- range .certs }}
-	{
-		Label:  "{{ .Label }}",
-		Serial: "{{ .Cert.SerialNumber }}",
-		Trust:  {{ .Trust }},
-		DER: {{ .Cert.Raw | indentbytes }},
-	},
-{{- end }}
-}
-{{end}}
-`
-var funcMap = template.FuncMap{
-	"indentbytes": indentBytes,
-}
-
-var tpl = template.Must(template.New("data").Funcs(funcMap).Parse(tplText))
-
 func fail(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", a...)
 	os.Exit(100)
@@ -191,76 +244,195 @@ func indentBytes(data []byte) string {
 }
 
 type hashReader struct {
-	hash.Hash
+	w io.Writer
 	r io.Reader
 }
 
 func (hr *hashReader) Read(p []byte) (n int, err error) {
 	n, err = hr.r.Read(p)
 	if n > 0 {
-		hr.Hash.Write(p[0:n])
+		hr.w.Write(p[0:n])
 	}
 	return n, err
 }
 
-func newHashReader(r io.Reader, h hash.Hash) *hashReader {
-	return &hashReader{h, r}
+func newHashReader(r io.Reader, w io.Writer) *hashReader {
+	return &hashReader{w, r}
+}
+
+// generationTime returns the time to record in the generated file.  It honors
+// the SOURCE_DATE_EPOCH environment variable so that output can be reproduced.
+func generationTime() (time.Time, error) {
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		secs, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Now(), nil
+}
+
+// sourceFlags lists the flags that describe the source, which override any
+// sources given in a config file when set on the command line.
+var sourceFlags = []string{"download", "url", "source", "source-format", "source-trust", "sig", "pubkey", "expect-sha256"}
+
+// flagSource returns the source described by the command line flags.
+func flagSource() sourceSpec {
+	spec := sourceSpec{
+		Path:   *sourceFile,
+		Format: *sourceFmt,
+		Trust:  *sourceTrust,
+		SHA256: normalizeFingerprint(*expectSHA),
+		Sig:    *sigFile,
+		PubKey: *pubKeyFile,
+	}
+	if *download {
+		spec.Path, spec.URL = "", *downloadURL
+	}
+	return spec
 }
 
 func main() {
 	flag.Parse()
 
-	var (
-		source io.Reader
-		target io.Writer
-		err    error
-	)
+	explicit := commandLineFlags(flag.CommandLine)
+	cfg := new(config)
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(flag.CommandLine, *configFile, explicit); err != nil {
+			fail("Failed to load config: %s", err)
+		}
+	}
 
-	if *download {
-		resp, err := http.Get(*downloadURL)
-		if err != nil {
-			fail("Failed to download source: %s", err)
+	sources := configSources(cfg, explicit)
+	if len(sources) == 0 {
+		if _, err := certparse.ParseTrustLevel(*sourceTrust); err != nil {
+			fail("Invalid -source-trust: %s", err)
+		}
+		if *sigFile != "" && *pubKeyFile == "" {
+			fail("A public key must be supplied with -pubkey")
 		}
-		if resp.StatusCode < 200 || resp.StatusCode > 299 {
-			fail("Non-200 status code when downloading source: %s", resp.Status)
+		if *pubKeyFile != "" && *sigFile == "" {
+			fail("A signature must be supplied with -sig")
 		}
-		source = resp.Body
+		sources = []sourceSpec{flagSource()}
+	}
 
-	} else if *sourceFile == "" || *sourceFile == "-" {
-		source = os.Stdin
+	outputs := configOutputs(cfg, explicit)
+	if len(outputs) == 0 {
+		if *outputFile != "" || len(extraOutputs) == 0 {
+			outputs = append(outputs, outputSpec{Path: *outputFile, Format: outputGo})
+		}
+		outputs = append(outputs, extraOutputs...)
+	}
+	for _, out := range outputs {
+		if *variants && out.Format == outputGo && (out.Path == "" || out.Path == "-") {
+			fail("-variants requires -target to name a file")
+		}
+		if *interFile != "" && out.Format == outputGo && (out.Path == "" || out.Path == "-") {
+			fail("-intermediates requires -target to name a file")
+		}
+	}
 
-	} else {
-		source, err = os.Open(*sourceFile)
-		if err != nil {
-			fail("Failed to open source file: %s", err)
+	var err error
+	if *tplFile != defaultTemplate {
+		if tpl, err = loadTemplate(*tplFile); err != nil {
+			fail("Failed to load template: %s", err)
+		}
+	}
+
+	d := &downloader{
+		cacheDir: *cacheDir,
+		retries:  *retries,
+		backoff:  time.Second,
+		offline:  *offline,
+	}
+	for _, spec := range sources {
+		if spec.URL != "" && d.client == nil {
+			if d.client, err = newDownloadClient(*dlRoots, *timeout); err != nil {
+				fail("Failed to load download roots: %s", err)
+			}
 		}
 	}
 
-	if *outputFile == "" || *outputFile == "-" {
-		target = os.Stdout
+	sha1Hash, sha256Hash := sha1.New(), sha256.New()
+	certs, signature, err := loadSources(sources, d, io.MultiWriter(sha1Hash, sha256Hash))
+	if err != nil {
+		fail("Failed to read certificates: %s", err)
+	}
 
-	} else {
-		target, err = os.Create(*outputFile)
+	if *crossRef != "" {
+		report, err := crossCheck(certs, *crossRef, *crossFmt)
 		if err != nil {
-			fail("Failed to open target file: %s", err)
+			fail("Cross-check failed: %s", err)
+		}
+		if report != "" {
+			if !*crossWarn {
+				fail("%s", report)
+			}
+			fmt.Fprintf(os.Stderr, "WARNING: %s\n", report)
 		}
 	}
 
-	hashSource := newHashReader(source, sha1.New())
+	if certs, err = applyOverlays(certs, cfg.Overlays); err != nil {
+		fail("Failed to apply overlays: %s", err)
+	}
+	if certs, err = applyFilters(certs, cfg.Filters); err != nil {
+		fail("Failed to apply filters: %s", err)
+	}
 
-	certs, err := certparse.ReadTrustedCerts(hashSource)
+	nameConstraints, err := loadConstraints(*constraints)
 	if err != nil {
-		fail("Failed to read certificates: %s", err)
+		fail("Failed to load constraints: %s", err)
+	}
+	if err := mergeConstraints(nameConstraints, cfg.Constraints); err != nil {
+		fail("Failed to load constraints: %s", err)
+	}
+
+	genTime, err := generationTime()
+	if err != nil {
+		fail("Invalid SOURCE_DATE_EPOCH: %s", err)
+	}
+
+	var intermediates []certparse.Cert
+	if *interFile != "" {
+		if intermediates, err = loadIntermediates(*interFile, *interFmt, certs, genTime); err != nil {
+			fail("Failed to read intermediates: %s", err)
+		}
 	}
 
 	tplParams := map[string]interface{}{
-		"package":  *packageName,
-		"certs":    certs,
-		"time":     time.Now().Format(time.RFC1123Z),
-		"filesha1": fmt.Sprintf("%0x", hashSource.Sum(nil)),
+		"package":     *packageName,
+		"certs":       certs,
+		"time":        genTime,
+		"filesha1":    fmt.Sprintf("%0x", sha1Hash.Sum(nil)),
+		"filesha256":  fmt.Sprintf("%0x", sha256Hash.Sum(nil)),
+		"revision":    *revision,
+		"constraints": nameConstraints,
+		"signature":   signature,
+		"variants":    *variants,
+		"compress":    *compress,
+	}
+	if *interFile != "" {
+		tplParams["intermediates"] = intermediates
+	}
+
+	if *compress {
+		reportCompression(certs, nameConstraints)
 	}
 
-	if err = tpl.ExecuteTemplate(target, "main", tplParams); err != nil {
-		fail("Template execution failed: %s", err)
+	// render everything before writing anything so that an error leaves all
+	// existing outputs untouched
+	var files []renderedFile
+	for _, out := range outputs {
+		rendered, err := renderOutput(out, tplParams, certs)
+		if err != nil {
+			fail("Failed to render %s output: %s", out.Format, err)
+		}
+		files = append(files, rendered...)
+	}
+	if err := writeOutputs(files); err != nil {
+		fail("Failed to write output: %s", err)
 	}
 }
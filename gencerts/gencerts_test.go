@@ -0,0 +1,47 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts/certparse"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+// testCert returns a self-signed CA certificate with the given label and trust.
+func testCert(t *testing.T, label string, trust certparse.TrustLevel) certparse.Cert {
+	kp := testpki.Issue(t, testpki.CATemplate(label), nil)
+	return certparse.Cert{Label: label, Data: kp.Cert.Raw, Trust: trust, Cert: kp.Cert}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	// labels from PEM and CCADB sources are free text
+	label := `Root "Quoted" C:\CA`
+	params := map[string]interface{}{
+		"package":     "rootcerts",
+		"certs":       []certparse.Cert{testCert(t, label, certparse.ServerTrustedDelegator)},
+		"time":        time.Unix(0, 0),
+		"filesha1":    "",
+		"filesha256":  "",
+		"revision":    "",
+		"constraints": map[string][]string{},
+	}
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, "main", params); err != nil {
+		t.Fatal("Template execution failed", err)
+	}
+	if _, err := parser.ParseFile(token.NewFileSet(), "rootcerts.go", buf.Bytes(), 0); err != nil {
+		t.Fatal("Generated code does not parse", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(strconv.Quote(label))) {
+		t.Error("Label was not quoted")
+	}
+}
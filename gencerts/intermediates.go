@@ -0,0 +1,86 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// intermediatesSuffix is appended to the name of -target to give the name of
+// the file holding the preloaded intermediates.
+const intermediatesSuffix = "intermediates"
+
+// readIntermediates parses a list of intermediate certificates from source
+// according to format, which is either pem or ccadb (the CCADB intermediate
+// certificate report).
+func readIntermediates(format string, source io.Reader) ([]certparse.Cert, error) {
+	switch format {
+	case certparse.FormatPEM:
+		return certparse.ReadPEMCerts(source, 0)
+	case certparse.FormatCCADB:
+		return certparse.ReadCCADBIntermediatesCSV(source)
+	}
+	return nil, fmt.Errorf("unsupported intermediates format %q; use %s or %s", format, certparse.FormatPEM, certparse.FormatCCADB)
+}
+
+// loadIntermediates reads the intermediates in path and returns those that
+// are worth preloading: CA certificates that are unexpired at now and are not
+// among roots.  Duplicates are dropped.
+func loadIntermediates(path, format string, roots []certparse.Cert, now time.Time) ([]certparse.Cert, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	certs, err := readIntermediates(format, f)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range roots {
+		seen[c.Fingerprint()] = true
+	}
+	var result []certparse.Cert
+	for _, c := range certs {
+		fp := c.Fingerprint()
+		if seen[fp] || !c.Cert.IsCA || now.After(c.Cert.NotAfter) {
+			continue
+		}
+		seen[fp] = true
+		c.Trust = 0
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// intermediatesPath returns the filename for the intermediates file that is
+// written alongside target.
+func intermediatesPath(target string) string {
+	return variantPath(target, intermediatesSuffix)
+}
+
+// renderIntermediates renders the file holding the preloaded intermediates,
+// which is written alongside target.
+func renderIntermediates(target string, params map[string]interface{}, intermediates []certparse.Cert) (renderedFile, error) {
+	iparams := make(map[string]interface{})
+	for k, v := range params {
+		iparams[k] = v
+	}
+	iparams["certs"] = intermediates
+	iparams["constraints"] = map[string][]string{}
+
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, "intermediates", iparams); err != nil {
+		return renderedFile{}, err
+	}
+	return renderedFile{intermediatesPath(target), buf.Bytes()}, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+func TestLoadIntermediates(t *testing.T) {
+	root := testCert(t, "Root", certparse.ServerTrustedDelegator)
+	inter := testCert(t, "Intermediate", 0)
+
+	var buf bytes.Buffer
+	for _, c := range []certparse.Cert{inter, root, inter} {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Data})
+	}
+	path := filepath.Join(t.TempDir(), "intermediates.pem")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := loadIntermediates(path, certparse.FormatPEM, []certparse.Cert{root}, time.Now())
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(certs) != 1 || certs[0].Fingerprint() != inter.Fingerprint() || certs[0].Trust != 0 {
+		t.Errorf("Incorrect intermediates %v", certs)
+	}
+
+	// expired intermediates are dropped
+	if certs, err = loadIntermediates(path, certparse.FormatPEM, nil, time.Now().Add(48*time.Hour)); err != nil || len(certs) != 0 {
+		t.Errorf("Expired intermediates were loaded (err=%v)", err)
+	}
+	if _, err := loadIntermediates(path, certparse.FormatDER, nil, time.Now()); err == nil {
+		t.Error("Unsupported format was accepted")
+	}
+}
+
+func TestRenderIntermediates(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "rootcerts.go")
+	intermediates := []certparse.Cert{testCert(t, `Intermediate "One"`, 0)}
+
+	for _, compress := range []bool{false, true} {
+		params := testTemplateParams(t)
+		params["compress"] = compress
+		params["intermediates"] = intermediates
+		files, err := renderOutput(outputSpec{Path: target, Format: outputGo}, params, params["certs"].([]certparse.Cert))
+		if err != nil {
+			t.Fatalf("compress=%t: Unexpected error %s", compress, err)
+		}
+		if len(files) != 2 || files[1].path != intermediatesPath(target) {
+			t.Fatalf("compress=%t: Incorrect files %d", compress, len(files))
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), files[1].path, files[1].data, 0)
+		if err != nil {
+			t.Fatalf("compress=%t: Failed to parse: %s", compress, err)
+		}
+		name := "preloadedIntermediates"
+		if compress {
+			name = "intermediatesBlob"
+		}
+		if f.Scope.Lookup(name) == nil {
+			t.Errorf("compress=%t: %s is not declared", compress, name)
+		}
+
+		// the roots and intermediates are verified separately
+		if err := verifyGoCerts(files[1:], params["certs"].([]certparse.Cert)); err == nil {
+			t.Errorf("compress=%t: Intermediates matched the roots", compress)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// Supported output formats.
+const (
+	outputGo   = "go"
+	outputPEM  = "pem"
+	outputJSON = "json"
+)
+
+// outputList implements flag.Value for the repeatable -output flag, whose
+// values take the form format=path.
+type outputList []outputSpec
+
+func (l *outputList) String() string {
+	var s []string
+	for _, o := range *l {
+		s = append(s, o.Format+"="+o.Path)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *outputList) Set(value string) error {
+	format, path, ok := strings.Cut(value, "=")
+	if !ok || path == "" {
+		return fmt.Errorf("%q should be of the form format=path", value)
+	}
+	if !isOutputFormat(format) {
+		return fmt.Errorf("unknown output format %q", format)
+	}
+	*l = append(*l, outputSpec{Path: path, Format: format})
+	return nil
+}
+
+func isOutputFormat(format string) bool {
+	switch format {
+	case outputGo, outputPEM, outputJSON:
+		return true
+	}
+	return false
+}
+
+// renderedFile holds the rendered content of a file to be written.
+type renderedFile struct {
+	path string // "" or "-" for stdout
+	data []byte
+}
+
+// renderOutput renders certs in the format required by out, using params as
+// the template data.  More than one file is returned for go output with
+// -variants or -intermediates set.
+func renderOutput(out outputSpec, params map[string]interface{}, certs []certparse.Cert) ([]renderedFile, error) {
+	var buf bytes.Buffer
+	switch out.Format {
+	case outputGo:
+		if err := tpl.ExecuteTemplate(&buf, "main", params); err != nil {
+			return nil, fmt.Errorf("template execution failed: %s", err)
+		}
+	case outputPEM:
+		certparse.WritePEM(&buf, certs)
+	case outputJSON:
+		if err := renderJSON(&buf, params, certs); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown output format %q", out.Format)
+	}
+	files := []renderedFile{{out.Path, buf.Bytes()}}
+	if out.Format != outputGo {
+		return files, nil
+	}
+
+	if params["variants"] == true {
+		vfiles, err := renderVariants(out.Path, params, certs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render variants: %s", err)
+		}
+		files = append(files, vfiles...)
+	}
+	// the intermediates are verified separately from the roots
+	roots := len(files)
+	intermediates, preload := params["intermediates"].([]certparse.Cert)
+	if preload {
+		f, err := renderIntermediates(out.Path, params, intermediates)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render intermediates: %s", err)
+		}
+		files = append(files, f)
+	}
+	for i, f := range files {
+		name := f.path
+		if name == "" || name == "-" {
+			name = "<stdout>"
+		}
+		data, err := formatGoSource(name, f.data)
+		if err != nil {
+			return nil, err
+		}
+		files[i].data = data
+	}
+	if *verifyOutput {
+		if err := verifyGoCerts(files[:roots], certs); err != nil {
+			return nil, err
+		}
+		if preload {
+			if err := verifyGoCerts(files[roots:], intermediates); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return files, nil
+}
+
+// writeOutputs replaces each file atomically.  Every file is first written to
+// a temporary file and only once all have been written are they renamed into
+// place, so that a failure to write any one leaves all of the existing files
+// untouched.  The renames are not atomic as a set: should one fail, the files
+// renamed before it have already been replaced.  Output to stdout is written
+// last.
+func writeOutputs(files []renderedFile) error {
+	temps := make([]string, len(files))
+	defer func() {
+		for _, tmp := range temps {
+			if tmp != "" {
+				os.Remove(tmp)
+			}
+		}
+	}()
+	for i, f := range files {
+		if f.path == "" || f.path == "-" {
+			continue
+		}
+		tmp, err := writeTemp(f.path, f.data)
+		if err != nil {
+			return err
+		}
+		temps[i] = tmp
+	}
+
+	for i, f := range files {
+		if temps[i] == "" {
+			continue
+		}
+		if err := os.Rename(temps[i], f.path); err != nil {
+			return err
+		}
+		temps[i] = ""
+		syncDir(filepath.Dir(f.path))
+	}
+	for _, f := range files {
+		if f.path == "" || f.path == "-" {
+			if _, err := os.Stdout.Write(f.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// renderJSON writes an inventory of certs, without the certificate data.
+func renderJSON(buf *bytes.Buffer, params map[string]interface{}, certs []certparse.Cert) error {
+	constraints, _ := params["constraints"].(map[string][]string)
+	var inv certparse.Inventory
+	if generated, ok := params["time"].(time.Time); ok {
+		inv.Generated = certparse.OptionalTime(generated)
+	}
+	inv.SourceSHA256, _ = params["filesha256"].(string)
+	inv.Revision, _ = params["revision"].(string)
+	for _, c := range certs {
+		inv.Certificates = append(inv.Certificates, certparse.NewInventoryCert(c, constraints[c.Fingerprint()]))
+	}
+	return certparse.WriteInventory(buf, inv)
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+func TestOutputList(t *testing.T) {
+	var l outputList
+	for _, v := range []string{"pem=roots.pem", "json=out/inventory.json"} {
+		if err := l.Set(v); err != nil {
+			t.Fatalf("%s: unexpected error %s", v, err)
+		}
+	}
+	expected := outputList{{Path: "roots.pem", Format: outputPEM}, {Path: "out/inventory.json", Format: outputJSON}}
+	if !reflect.DeepEqual(l, expected) {
+		t.Errorf("Incorrect outputs %v", l)
+	}
+
+	for _, v := range []string{"roots.pem", "pem=", "yaml=roots.yaml"} {
+		if err := l.Set(v); err == nil {
+			t.Errorf("%s: did not receive an error", v)
+		}
+	}
+}
+
+func TestRenderJSON(t *testing.T) {
+	cert := testCert(t, "Root", certparse.ServerTrustedDelegator|certparse.CodeTrustedDelegator)
+	params := map[string]interface{}{
+		"time":        time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		"filesha256":  "abcd",
+		"revision":    "NSS_3_50_RTM",
+		"constraints": map[string][]string{cert.Fingerprint(): {"example"}},
+	}
+	var buf bytes.Buffer
+	if err := renderJSON(&buf, params, []certparse.Cert{cert}); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	var inv certparse.Inventory
+	if err := json.Unmarshal(buf.Bytes(), &inv); err != nil {
+		t.Fatal("Failed to parse inventory", err)
+	}
+	if inv.Revision != "NSS_3_50_RTM" || inv.SourceSHA256 != "abcd" || len(inv.Certificates) != 1 {
+		t.Fatalf("Incorrect inventory %+v", inv)
+	}
+	c := inv.Certificates[0]
+	if c.SHA256 != cert.Fingerprint() || c.Label != "Root" || c.Serial != cert.Cert.SerialNumber.String() {
+		t.Errorf("Incorrect certificate %+v", c)
+	}
+	if !reflect.DeepEqual(c.Trust, []string{"server", "code"}) {
+		t.Errorf("Incorrect trust %v", c.Trust)
+	}
+	if !reflect.DeepEqual(c.PermittedDNSDomains, []string{"example"}) {
+		t.Errorf("Incorrect domains %v", c.PermittedDNSDomains)
+	}
+}
+
+func TestWriteOutputs(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "roots.pem")
+	if err := os.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []renderedFile{{path, []byte("new")}, {filepath.Join(dir, "inventory.json"), []byte("{}")}}
+	if err := writeOutputs(files); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	modes := []os.FileMode{0600, 0644} // existing permissions are kept
+	for i, f := range files {
+		data, err := os.ReadFile(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, f.data) {
+			t.Errorf("%s has incorrect content %q", f.path, data)
+		}
+		if fi, _ := os.Stat(f.path); fi.Mode().Perm() != modes[i] {
+			t.Errorf("%s has incorrect mode %s", f.path, fi.Mode())
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != len(files) {
+		t.Errorf("Temporary files were left behind: %d entries", len(entries))
+	}
+}
+
+func TestWriteOutputsFailure(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rootcerts.go")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second file can't be written, so the first must not be replaced
+	files := []renderedFile{{path, []byte("new")}, {filepath.Join(dir, "missing", "roots.pem"), []byte("new")}}
+	if err := writeOutputs(files); err == nil {
+		t.Fatal("Expected error")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Errorf("%s was replaced with %q", path, data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Temporary files were left behind: %d entries", len(entries))
+	}
+}
+
+func TestRenderOutputInvalid(t *testing.T) {
+	custom, err := loadTemplate(writeTestTemplate(t, `package {{.package}}
+
+var certs = []Cert{
+`))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	defer func(orig *template.Template) { tpl = orig }(tpl)
+	tpl = custom
+
+	if _, err := renderOutput(outputSpec{Path: "rootcerts.go", Format: outputGo}, testTemplateParams(t), nil); err == nil {
+		t.Error("Invalid Go output was not rejected")
+	}
+}
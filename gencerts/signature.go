@@ -0,0 +1,192 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Signatures are accepted either as raw ed25519 keys and signatures, or in
+// the format used by minisign (https://jedisct1.github.io/minisign/).  Only
+// minisign's pure ed25519 ("Ed") algorithm is supported, as the prehashed
+// variant requires BLAKE2b which is not part of the standard library.
+
+var minisignAlg = []byte("Ed")
+
+const (
+	keyIDLen          = 8
+	minisignKeyLen    = 2 + keyIDLen + ed25519.PublicKeySize
+	minisignSigLen    = 2 + keyIDLen + ed25519.SignatureSize
+	trustedCommentTag = "trusted comment: "
+)
+
+// signingKey is an ed25519 public key used to verify the source data.
+type signingKey struct {
+	id  [keyIDLen]byte
+	key ed25519.PublicKey
+}
+
+// ID returns the key ID in the hex format displayed by minisign.
+func (k *signingKey) ID() string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(k.id[:]))
+}
+
+// sigInfo describes a successfully verified signature.
+type sigInfo struct {
+	KeyID  string // ID of the key that produced the signature
+	Digest string // hex encoded SHA256 hash of the signature file
+}
+
+// decodeLines returns the non-comment lines of a key or signature file.
+// Lines starting with "untrusted comment:" are dropped, while trusted
+// comments are retained.
+func decodeLines(data []byte) (lines []string) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// parseSigningKey parses a minisign public key file, or a base64 encoded raw
+// ed25519 public key.  Raw keys are given an ID derived from their SHA256 hash.
+func parseSigningKey(data []byte) (*signingKey, error) {
+	lines := decodeLines(data)
+	if len(lines) != 1 {
+		return nil, errors.New("expected a single base64 encoded public key")
+	}
+	b, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key encoding: %s", err)
+	}
+
+	var k signingKey
+	switch len(b) {
+	case ed25519.PublicKeySize:
+		sum := sha256.Sum256(b)
+		copy(k.id[:], sum[:])
+		k.key = ed25519.PublicKey(b)
+	case minisignKeyLen:
+		if !bytes.Equal(b[:2], minisignAlg) {
+			return nil, fmt.Errorf("unsupported public key algorithm %q", b[:2])
+		}
+		copy(k.id[:], b[2:])
+		k.key = ed25519.PublicKey(b[2+keyIDLen:])
+	default:
+		return nil, fmt.Errorf("invalid public key length %d", len(b))
+	}
+	return &k, nil
+}
+
+// verifySignature verifies that sigData contains a valid detached signature
+// over msg produced by key.  sigData may be a minisign signature file, or a
+// raw ed25519 signature either in binary or base64 encoded form.
+func verifySignature(key *signingKey, sigData, msg []byte) (*sigInfo, error) {
+	digest := sha256.Sum256(sigData)
+	info := &sigInfo{KeyID: key.ID(), Digest: fmt.Sprintf("%0x", digest[:])}
+
+	if len(sigData) == ed25519.SignatureSize {
+		if !ed25519.Verify(key.key, msg, sigData) {
+			return nil, errors.New("signature verification failed")
+		}
+		return info, nil
+	}
+
+	lines := decodeLines(sigData)
+	if len(lines) == 0 {
+		return nil, errors.New("empty signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature encoding: %s", err)
+	}
+
+	switch len(sig) {
+	case ed25519.SignatureSize:
+		if !ed25519.Verify(key.key, msg, sig) {
+			return nil, errors.New("signature verification failed")
+		}
+
+	case minisignSigLen:
+		if !bytes.Equal(sig[:2], minisignAlg) {
+			return nil, fmt.Errorf("unsupported signature algorithm %q", sig[:2])
+		}
+		if !bytes.Equal(sig[2:2+keyIDLen], key.id[:]) {
+			return nil, errors.New("signature was not produced by the supplied public key")
+		}
+		sig = sig[2+keyIDLen:]
+		if !ed25519.Verify(key.key, msg, sig) {
+			return nil, errors.New("signature verification failed")
+		}
+		if err := verifyTrustedComment(key, sig, lines[1:]); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid signature length %d", len(sig))
+	}
+	return info, nil
+}
+
+// verifyTrustedComment checks minisign's global signature, which covers the
+// signature together with the trusted comment.
+func verifyTrustedComment(key *signingKey, sig []byte, lines []string) error {
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], trustedCommentTag) {
+		return errors.New("signature is missing its trusted comment")
+	}
+	global, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil {
+		return fmt.Errorf("invalid global signature encoding: %s", err)
+	}
+	signed := append(append([]byte{}, sig...), lines[0][len(trustedCommentTag):]...)
+	if !ed25519.Verify(key.key, signed, global) {
+		return errors.New("trusted comment verification failed")
+	}
+	return nil
+}
+
+// verifySource reads all of source and verifies it against the signature in
+// sigFile using the public key in keyFile.  It returns a reader that supplies
+// the verified data.
+func verifySource(source io.Reader, sigFile, keyFile string) (*sigInfo, io.Reader, error) {
+	if keyFile == "" {
+		return nil, nil, errors.New("a public key must be supplied with -pubkey")
+	}
+	keyData, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parseSigningKey(keyData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %s", keyFile, err)
+	}
+	sigData, err := os.ReadFile(sigFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := verifySignature(key, sigData, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return info, bytes.NewReader(data), nil
+}
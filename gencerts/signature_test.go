@@ -0,0 +1,118 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testMessage = []byte("BEGINDATA\n")
+
+type testMinisignKey struct {
+	id   []byte
+	pub  ed25519.PublicKey
+	priv ed25519.PrivateKey
+}
+
+func newTestMinisignKey(t *testing.T) *testMinisignKey {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate key", err)
+	}
+	id := make([]byte, keyIDLen)
+	rand.Read(id)
+	return &testMinisignKey{id: id, pub: pub, priv: priv}
+}
+
+func (k *testMinisignKey) publicKeyFile() []byte {
+	b := append(append(append([]byte{}, minisignAlg...), k.id...), k.pub...)
+	return []byte("untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(b) + "\n")
+}
+
+func (k *testMinisignKey) sign(msg []byte, comment string) []byte {
+	sig := ed25519.Sign(k.priv, msg)
+	b := append(append(append([]byte{}, minisignAlg...), k.id...), sig...)
+	global := ed25519.Sign(k.priv, append(sig, comment...))
+	return []byte(fmt.Sprintf("untrusted comment: signature\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(b), comment, base64.StdEncoding.EncodeToString(global)))
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	k := newTestMinisignKey(t)
+	key, err := parseSigningKey(k.publicKeyFile())
+	if err != nil {
+		t.Fatal("Failed to parse public key", err)
+	}
+	sig := k.sign(testMessage, "timestamp:1234")
+
+	info, err := verifySignature(key, sig, testMessage)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if info.KeyID != key.ID() || len(info.KeyID) != 16 {
+		t.Errorf("Incorrect key ID %q", info.KeyID)
+	}
+	if len(info.Digest) != 64 {
+		t.Errorf("Incorrect signature digest %q", info.Digest)
+	}
+
+	if _, err := verifySignature(key, sig, []byte("BEGINDATA\nmodified")); err == nil {
+		t.Error("Modified message was not rejected")
+	}
+
+	other, _ := parseSigningKey(newTestMinisignKey(t).publicKeyFile())
+	if _, err := verifySignature(other, sig, testMessage); err == nil {
+		t.Error("Signature from another key was not rejected")
+	}
+
+	sig = k.sign(testMessage, "original")
+	tampered := []byte(strings.Replace(string(sig), "trusted comment: original", "trusted comment: modified", 1))
+	if _, err := verifySignature(key, tampered, testMessage); err == nil {
+		t.Error("Modified trusted comment was not rejected")
+	}
+}
+
+func TestVerifyRawEd25519(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal("Failed to generate key", err)
+	}
+	key, err := parseSigningKey([]byte(base64.StdEncoding.EncodeToString(pub)))
+	if err != nil {
+		t.Fatal("Failed to parse public key", err)
+	}
+	sig := ed25519.Sign(priv, testMessage)
+
+	for name, sigData := range map[string][]byte{
+		"binary": sig,
+		"base64": []byte(base64.StdEncoding.EncodeToString(sig) + "\n"),
+	} {
+		if _, err := verifySignature(key, sigData, testMessage); err != nil {
+			t.Errorf("%s: unexpected error %s", name, err)
+		}
+		if _, err := verifySignature(key, sigData, []byte("other")); err == nil {
+			t.Errorf("%s: modified message was not rejected", name)
+		}
+	}
+}
+
+func TestParseSigningKeyErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":      "",
+		"not base64": "untrusted comment: x\n!!!\n",
+		"bad length": base64.StdEncoding.EncodeToString([]byte("short")),
+		"bad alg":    base64.StdEncoding.EncodeToString(append([]byte("ED"), make([]byte, keyIDLen+ed25519.PublicKeySize)...)),
+	}
+	for name, data := range tests {
+		if _, err := parseSigningKey([]byte(data)); err == nil {
+			t.Errorf("%s: did not receive an error", name)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// readCerts parses certificates from source according to format, as for
+// certparse.ReadSource.  As DER input is read from the directory dir rather
+// than source, h receives the certificate data instead.
+func readCerts(format string, source io.Reader, dir string, trust certparse.TrustLevel, h io.Writer) ([]certparse.Cert, error) {
+	if format == certparse.FormatDER && dir == "" {
+		return nil, fmt.Errorf("the %s format requires -source to name a directory", certparse.FormatDER)
+	}
+	certs, err := certparse.ReadSource(format, source, dir, trust)
+	if err != nil {
+		return nil, err
+	}
+	if format == certparse.FormatDER {
+		for _, c := range certs {
+			h.Write(c.Data)
+		}
+	}
+	return certs, nil
+}
+
+// name returns a description of the source for use in error messages.
+func (s sourceSpec) name() string {
+	switch {
+	case s.URL != "":
+		return s.URL
+	case s.Path == "" || s.Path == "-":
+		return "stdin"
+	}
+	return s.Path
+}
+
+// loadSources reads the certificates from each source in turn and merges
+// them.  h receives the data of every source so that a hash of the combined
+// input can be recorded.  d is used to fetch any sources given by URL.  The
+// signature of the first signed source is returned.
+func loadSources(specs []sourceSpec, d *downloader, h io.Writer) ([]certparse.Cert, *sigInfo, error) {
+	var (
+		all       []certparse.Cert
+		signature *sigInfo
+	)
+	for _, spec := range specs {
+		certs, sig, err := loadSource(spec, d, h)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", spec.name(), err)
+		}
+		if signature == nil {
+			signature = sig
+		}
+		all = mergeCerts(all, certs)
+	}
+	return all, signature, nil
+}
+
+// loadSource reads the certificates from a single source, verifying its
+// signature and expected hash if they are set.
+func loadSource(spec sourceSpec, d *downloader, h io.Writer) ([]certparse.Cert, *sigInfo, error) {
+	trust, err := certparse.ParseTrustLevel(spec.Trust)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var source io.Reader
+	switch {
+	case spec.URL != "":
+		data, err := d.fetch(spec.URL)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to download: %s", err)
+		}
+		source = bytes.NewReader(data)
+
+	case spec.Path == "" || spec.Path == "-":
+		source = os.Stdin
+
+	case spec.Format == certparse.FormatDER:
+		// the directory is read by readCerts
+
+	default:
+		f, err := os.Open(spec.Path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		source = f
+	}
+
+	var signature *sigInfo
+	if spec.Sig != "" {
+		if source == nil {
+			return nil, nil, fmt.Errorf("signature verification is not supported for %s sources", certparse.FormatDER)
+		}
+		if signature, source, err = verifySource(source, spec.Sig, spec.PubKey); err != nil {
+			return nil, nil, fmt.Errorf("failed to verify signature: %s", err)
+		}
+	}
+
+	sum := sha256.New()
+	w := io.MultiWriter(h, sum)
+	if source != nil {
+		source = newHashReader(source, w)
+	}
+	certs, err := readCerts(spec.Format, source, spec.Path, trust, w)
+	if err != nil {
+		return nil, nil, err
+	}
+	if source != nil {
+		// hash any trailing data the parser did not need to read
+		if _, err := io.Copy(io.Discard, source); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if spec.SHA256 != "" {
+		if actual := hex.EncodeToString(sum.Sum(nil)); actual != spec.SHA256 {
+			return nil, nil, fmt.Errorf("SHA256 mismatch: expected %s, got %s", spec.SHA256, actual)
+		}
+	}
+	return certs, signature, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// defaultTemplate names the built-in template used unless -template is set.
+const defaultTemplate = "default"
+
+//go:embed templates/*.tmpl
+var templateFS embed.FS
+
+var funcMap = template.FuncMap{
+	"indentbytes": indentBytes,
+	"blob":        blobConst,
+}
+
+// tpl holds the templates used to generate output.
+var tpl = template.Must(loadTemplate(defaultTemplate))
+
+// loadTemplate returns the built-in templates.  If name is the path to a
+// template file rather than the name of a built-in template, that file is
+// parsed on top of the built-in definitions: it may redefine any of the
+// named templates (main, header, certlist, variant and intermediates) and, if
+// it has a non-empty body outside of any definition, that body replaces main.
+func loadTemplate(name string) (*template.Template, error) {
+	base, err := template.New("main").Funcs(funcMap).ParseFS(templateFS, "templates/"+defaultTemplate+".tmpl")
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || name == defaultTemplate {
+		return base, nil
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := base.New("main").Parse(string(data)); err != nil {
+		return nil, fmt.Errorf("%s: %s", filepath.Base(name), err)
+	}
+	return base, nil
+}
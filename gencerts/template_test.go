@@ -0,0 +1,93 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+func testTemplateParams(t *testing.T) map[string]interface{} {
+	return map[string]interface{}{
+		"package":     "rootcerts",
+		"certs":       []certparse.Cert{testCert(t, "Test Root", certparse.ServerTrustedDelegator)},
+		"time":        time.Unix(0, 0),
+		"revision":    "",
+		"constraints": map[string][]string{},
+	}
+}
+
+func writeTestTemplate(t *testing.T, text string) string {
+	path := filepath.Join(t.TempDir(), "custom.tmpl")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTemplateOverride(t *testing.T) {
+	path := writeTestTemplate(t, `{{define "header"}}// Licensed under the Example License
+
+package {{.package}}
+{{end}}`)
+	custom, err := loadTemplate(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	var out bytes.Buffer
+	if err := custom.ExecuteTemplate(&out, "main", testTemplateParams(t)); err != nil {
+		t.Fatal("Template execution failed", err)
+	}
+	if !strings.HasPrefix(out.String(), "// Licensed under the Example License\n") {
+		t.Error("Header was not overridden")
+	}
+	if !strings.Contains(out.String(), `Label:  "Test Root"`) {
+		t.Error("Built-in main template was not used")
+	}
+
+	// the built-in template must not be modified
+	out.Reset()
+	if err := tpl.ExecuteTemplate(&out, "main", testTemplateParams(t)); err != nil {
+		t.Fatal("Template execution failed", err)
+	}
+	if strings.Contains(out.String(), "Example License") {
+		t.Error("Default template was modified")
+	}
+}
+
+func TestLoadTemplateMain(t *testing.T) {
+	path := writeTestTemplate(t, `package {{.package}}
+{{range .certs}}// {{.Label}} {{.Fingerprint}} {{.Trust}}
+{{end}}`)
+	custom, err := loadTemplate(path)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	params := testTemplateParams(t)
+	var out bytes.Buffer
+	if err := custom.ExecuteTemplate(&out, "main", params); err != nil {
+		t.Fatal("Template execution failed", err)
+	}
+	cert := params["certs"].([]certparse.Cert)[0]
+	expected := "package rootcerts\n// Test Root " + cert.Fingerprint() + " server\n"
+	if out.String() != expected {
+		t.Errorf("Incorrect output\nexpected=%q\nactual=%q", expected, out.String())
+	}
+}
+
+func TestLoadTemplateErrors(t *testing.T) {
+	if _, err := loadTemplate(filepath.Join(t.TempDir(), "missing.tmpl")); err == nil {
+		t.Error("Missing file did not fail")
+	}
+	if _, err := loadTemplate(writeTestTemplate(t, "{{ .unterminated")); err == nil {
+		t.Error("Invalid template did not fail")
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"strconv"
+	"strings"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// maxSyntaxErrors is the number of syntax errors included in a report.
+const maxSyntaxErrors = 10
+
+// formatGoSource checks that src, the rendered content of the file name, is
+// valid Go source and returns it formatted as gofmt would.
+func formatGoSource(name string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	if _, err := parser.ParseFile(fset, name, src, parser.AllErrors); err != nil {
+		return nil, syntaxReport(src, err)
+	}
+	return format.Source(src)
+}
+
+// syntaxReport describes the errors returned by the parser, quoting the
+// offending line of src for each.
+func syntaxReport(src []byte, err error) error {
+	list, ok := err.(scanner.ErrorList)
+	if !ok {
+		return err
+	}
+	lines := bytes.Split(src, []byte("\n"))
+	var report strings.Builder
+	fmt.Fprintf(&report, "generated code is not valid Go:")
+	for i, e := range list {
+		if i == maxSyntaxErrors {
+			fmt.Fprintf(&report, "\n  ... and %d more errors", len(list)-i)
+			break
+		}
+		fmt.Fprintf(&report, "\n  %s", e)
+		if n := e.Pos.Line; n > 0 && n <= len(lines) {
+			fmt.Fprintf(&report, "\n    %s", bytes.TrimSpace(lines[n-1]))
+		}
+	}
+	return fmt.Errorf("%s", report.String())
+}
+
+// generatedCert is a certificate recovered from generated Go source.
+type generatedCert struct {
+	file  string
+	trust certparse.TrustLevel
+	der   []byte
+}
+
+// verifyGoCerts re-decodes the certificates held in the rendered Go files
+// and checks that they are exactly those in certs, with the same trust.  It
+// returns an error describing every mismatch found.
+func verifyGoCerts(files []renderedFile, certs []certparse.Cert) error {
+	var found []generatedCert
+	for _, f := range files {
+		gcerts, err := extractCerts(f.path, f.data)
+		if err != nil {
+			return err
+		}
+		found = append(found, gcerts...)
+	}
+
+	expected := make(map[string]certparse.Cert)
+	for _, c := range certs {
+		expected[c.Fingerprint()] = c
+	}
+
+	var problems []string
+	seen := make(map[string]bool)
+	for _, g := range found {
+		sum := sha256.Sum256(g.der)
+		fp := hex.EncodeToString(sum[:])
+		if _, err := x509.ParseCertificate(g.der); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid certificate in %s: %s: %s", g.file, fp, err))
+			continue
+		}
+		c, ok := expected[fp]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("unexpected certificate in %s: %s", g.file, fp))
+		case seen[fp]:
+			problems = append(problems, fmt.Sprintf("duplicate certificate in %s: %s %q", g.file, fp, c.Label))
+		case g.trust != c.Trust:
+			problems = append(problems, fmt.Sprintf("incorrect trust in %s: %s %q has %q, expected %q",
+				g.file, fp, c.Label, g.trust, c.Trust))
+		}
+		seen[fp] = true
+	}
+	for _, c := range certs {
+		if !seen[c.Fingerprint()] {
+			problems = append(problems, fmt.Sprintf("missing certificate: %s %q", c.Fingerprint(), c.Label))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("generated code does not match the input certificates:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// extractCerts returns the certificates held in the Go source src, found
+// either as Cert literals with a DER field or in the compressed blob constants
+// emitted by -compress.
+func extractCerts(name string, src []byte) (certs []generatedCert, err error) {
+	if name == "" || name == "-" {
+		name = "<stdout>"
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), name, src, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	ast.Inspect(f, func(n ast.Node) bool {
+		if err != nil {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.CompositeLit:
+			if c, ok, cerr := certLiteral(n); cerr != nil {
+				err = fmt.Errorf("%s: %s", name, cerr)
+			} else if ok {
+				c.file = name
+				certs = append(certs, c)
+				return false
+			}
+
+		case *ast.ValueSpec:
+			for i, id := range n.Names {
+				if !strings.HasSuffix(id.Name, "Blob") || i >= len(n.Values) {
+					continue
+				}
+				blob, ok := stringExpr(n.Values[i])
+				if !ok {
+					continue
+				}
+				decoded, derr := decodeCerts([]byte(blob))
+				if derr != nil {
+					err = fmt.Errorf("%s: failed to decode %s: %s", name, id.Name, derr)
+					return false
+				}
+				for _, c := range decoded {
+					certs = append(certs, generatedCert{file: name, trust: c.Trust, der: c.DER})
+				}
+			}
+		}
+		return true
+	})
+	return certs, err
+}
+
+// certLiteral extracts the DER and Trust fields from a composite literal.  It
+// reports false if lit has no DER field.
+func certLiteral(lit *ast.CompositeLit) (c generatedCert, ok bool, err error) {
+	for _, elt := range lit.Elts {
+		kv, isKV := elt.(*ast.KeyValueExpr)
+		if !isKV {
+			continue
+		}
+		key, isIdent := kv.Key.(*ast.Ident)
+		if !isIdent {
+			continue
+		}
+		switch key.Name {
+		case "DER":
+			data, isLit := kv.Value.(*ast.CompositeLit)
+			if !isLit {
+				return c, false, fmt.Errorf("DER field is not a literal")
+			}
+			for _, b := range data.Elts {
+				v, isBasic := b.(*ast.BasicLit)
+				if !isBasic || v.Kind != token.INT {
+					return c, false, fmt.Errorf("DER field holds a non-integer element")
+				}
+				n, perr := strconv.ParseUint(v.Value, 0, 8)
+				if perr != nil {
+					return c, false, fmt.Errorf("invalid DER byte %s", v.Value)
+				}
+				c.der = append(c.der, byte(n))
+			}
+			ok = true
+
+		case "Trust":
+			if v, isBasic := kv.Value.(*ast.BasicLit); isBasic && v.Kind == token.INT {
+				n, _ := strconv.ParseUint(v.Value, 0, 8)
+				c.trust = certparse.TrustLevel(n)
+			}
+		}
+	}
+	return c, ok, nil
+}
+
+// stringExpr evaluates a string literal or a concatenation of them.
+func stringExpr(e ast.Expr) (string, bool) {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.STRING {
+			return "", false
+		}
+		s, err := strconv.Unquote(e.Value)
+		return s, err == nil
+	case *ast.BinaryExpr:
+		if e.Op != token.ADD {
+			return "", false
+		}
+		x, ok := stringExpr(e.X)
+		if !ok {
+			return "", false
+		}
+		y, ok := stringExpr(e.Y)
+		return x + y, ok
+	}
+	return "", false
+}
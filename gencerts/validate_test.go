@@ -0,0 +1,79 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+func TestFormatGoSource(t *testing.T) {
+	src := "package rootcerts\nvar  x   =  []byte{1,2}\n"
+	out, err := formatGoSource("rootcerts.go", []byte(src))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if expected := "package rootcerts\n\nvar x = []byte{1, 2}\n"; string(out) != expected {
+		t.Errorf("Incorrect formatting %q", out)
+	}
+
+	src = "package rootcerts\n\nvar x = []byte{1, 2\nvar y = 3\n"
+	_, err = formatGoSource("rootcerts.go", []byte(src))
+	if err == nil {
+		t.Fatal("Invalid source did not fail")
+	}
+	if !strings.Contains(err.Error(), "rootcerts.go:4:") || !strings.Contains(err.Error(), "var y = 3") {
+		t.Errorf("Error does not identify the offending line: %s", err)
+	}
+}
+
+func TestVerifyGoCerts(t *testing.T) {
+	certs := []certparse.Cert{
+		testCert(t, "server", certparse.ServerTrustedDelegator),
+		testCert(t, "email", certparse.EmailTrustedDelegator),
+	}
+	extra := testCert(t, "extra", certparse.ServerTrustedDelegator)
+
+	for _, compress := range []bool{false, true} {
+		params := testTemplateParams(t)
+		params["certs"] = certs
+		params["compress"] = compress
+		files, err := renderOutput(outputSpec{Path: "rootcerts.go", Format: outputGo}, params, certs)
+		if err != nil {
+			t.Fatalf("compress=%t: unexpected error %s", compress, err)
+		}
+
+		type verifyTest struct {
+			files    []renderedFile
+			certs    []certparse.Cert
+			expected string // substring of the error; empty if no error is expected
+		}
+		tests := []verifyTest{
+			{files, certs, ""},
+			{files, certs[:1], "unexpected certificate in rootcerts.go: " + certs[1].Fingerprint()},
+			{files, append(certs, extra), "missing certificate: " + extra.Fingerprint()},
+			{append(files, files...), certs, "duplicate certificate in rootcerts.go: " + certs[0].Fingerprint()},
+		}
+		if !compress {
+			modified := bytes.Replace(files[0].data, []byte("Trust:  2,"), []byte("Trust:  3,"), 1)
+			tests = append(tests, verifyTest{[]renderedFile{{"rootcerts.go", modified}}, certs, `"email" has "server,email", expected "email"`})
+		}
+
+		for i, test := range tests {
+			err := verifyGoCerts(test.files, test.certs)
+			switch {
+			case test.expected == "" && err != nil:
+				t.Errorf("compress=%t test %d: unexpected error %s", compress, i, err)
+			case test.expected != "" && err == nil:
+				t.Errorf("compress=%t test %d: did not receive an error", compress, i)
+			case err != nil && !strings.Contains(err.Error(), test.expected):
+				t.Errorf("compress=%t test %d: error %q does not contain %q", compress, i, err, test.expected)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// purposeTags lists the build tags that select which certificates are
+// compiled into a binary when output is generated with -variants.
+var purposeTags = []struct {
+	trust certparse.TrustLevel
+	name  string
+	tag   string
+}{
+	{certparse.ServerTrustedDelegator, "server", "rootcerts_server_only"},
+	{certparse.EmailTrustedDelegator, "email", "rootcerts_email_only"},
+	{certparse.CodeTrustedDelegator, "code", "rootcerts_code_only"},
+}
+
+const allPurposes = certparse.ServerTrustedDelegator | certparse.EmailTrustedDelegator | certparse.CodeTrustedDelegator
+
+// variantBuildTag returns the build constraint for the file holding certificates
+// with exactly the given trust.  The file is included if no purpose tags are set,
+// or if any of the tags matching its purposes are set.
+func variantBuildTag(trust certparse.TrustLevel) string {
+	var none, any []string
+	for _, p := range purposeTags {
+		none = append(none, "!"+p.tag)
+		if trust&p.trust != 0 {
+			any = append(any, p.tag)
+		}
+	}
+	return "(" + strings.Join(none, " && ") + ") || " + strings.Join(any, " || ")
+}
+
+// variantNames returns the variable name and file name suffix used for the
+// certificates with exactly the given trust.
+func variantNames(trust certparse.TrustLevel) (varname, suffix string) {
+	var names []string
+	varname = "certs"
+	for _, p := range purposeTags {
+		if trust&p.trust != 0 {
+			names = append(names, p.name)
+			varname += strings.ToUpper(p.name[:1]) + p.name[1:]
+		}
+	}
+	return varname, strings.Join(names, "_")
+}
+
+// variantPath returns the filename for the variant file with the given suffix.
+func variantPath(target, suffix string) string {
+	return strings.TrimSuffix(target, ".go") + "_" + suffix + ".go"
+}
+
+// renderVariants renders a file to be written alongside target for every
+// combination of trust purposes, each holding the certificates with exactly
+// that trust.  Files are rendered even if they hold no certificates so that
+// no stale file is left behind.
+func renderVariants(target string, params map[string]interface{}, certs []certparse.Cert) ([]renderedFile, error) {
+	var files []renderedFile
+	for trust := certparse.TrustLevel(1); trust <= allPurposes; trust++ {
+		var group []certparse.Cert
+		for _, c := range certs {
+			if c.Trust == trust {
+				group = append(group, c)
+			}
+		}
+
+		varname, suffix := variantNames(trust)
+		vparams := make(map[string]interface{})
+		for k, v := range params {
+			vparams[k] = v
+		}
+		vparams["certs"] = group
+		vparams["buildtag"] = variantBuildTag(trust)
+		vparams["varname"] = varname
+		vparams["purposes"] = trust.String()
+
+		var buf bytes.Buffer
+		if err := tpl.ExecuteTemplate(&buf, "variant", vparams); err != nil {
+			return nil, err
+		}
+		files = append(files, renderedFile{variantPath(target, suffix), buf.Bytes()})
+	}
+	return files, nil
+}
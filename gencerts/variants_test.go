@@ -0,0 +1,77 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"go/build/constraint"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+func TestVariantBuildTags(t *testing.T) {
+	tests := []struct {
+		tags     []string
+		included certparse.TrustLevel // purposes that must be included
+	}{
+		{nil, allPurposes},
+		{[]string{"rootcerts_server_only"}, certparse.ServerTrustedDelegator},
+		{[]string{"rootcerts_email_only", "rootcerts_code_only"}, certparse.EmailTrustedDelegator | certparse.CodeTrustedDelegator},
+	}
+
+	for _, test := range tests {
+		set := make(map[string]bool)
+		for _, tag := range test.tags {
+			set[tag] = true
+		}
+		for trust := certparse.TrustLevel(1); trust <= allPurposes; trust++ {
+			expr, err := constraint.Parse("//go:build " + variantBuildTag(trust))
+			if err != nil {
+				t.Fatalf("trust %s: invalid constraint: %s", trust, err)
+			}
+			expected := trust&test.included != 0
+			if actual := expr.Eval(func(tag string) bool { return set[tag] }); actual != expected {
+				t.Errorf("tags %v trust %s: expected included=%t", test.tags, trust, expected)
+			}
+		}
+	}
+}
+
+func TestRenderVariants(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "rootcerts.go")
+	params := map[string]interface{}{
+		"package":     "rootcerts",
+		"time":        time.Now(),
+		"constraints": map[string][]string{},
+	}
+	certs := []certparse.Cert{
+		testCert(t, "server", certparse.ServerTrustedDelegator),
+		testCert(t, "all", allPurposes),
+	}
+	files, err := renderVariants(target, params, certs)
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if err := writeOutputs(files); err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+
+	fset := token.NewFileSet()
+	for trust := certparse.TrustLevel(1); trust <= allPurposes; trust++ {
+		varname, suffix := variantNames(trust)
+		path := variantPath(target, suffix)
+		f, err := parser.ParseFile(fset, path, nil, 0)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %s", path, err)
+		}
+		if f.Scope.Lookup(varname) == nil {
+			t.Errorf("%s does not declare %s", path, varname)
+		}
+	}
+}
@@ -1,5 +1,7 @@
 module github.com/gwatts/rootcerts
 
-go 1.16
+go 1.22
 
 require github.com/kr/pretty v0.2.1
+
+require github.com/kr/text v0.1.0 // indirect
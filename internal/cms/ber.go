@@ -0,0 +1,143 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package cms
+
+import (
+	"errors"
+)
+
+// maxDepth limits the nesting of elements accepted by berToDER.
+const maxDepth = 64
+
+var errTruncated = errors.New("cms: truncated BER data")
+
+// berToDER converts BER encoded data to DER so that it may be parsed by
+// encoding/asn1.  Indefinite lengths are replaced by definite ones and
+// constructed OCTET STRINGs, as produced by streaming encoders such as
+// OpenSSL's, are joined into a single primitive string.  DER input is
+// returned unchanged.
+func berToDER(ber []byte) ([]byte, error) {
+	ident, content, rest, err := convertElement(ber, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("cms: trailing data after BER element")
+	}
+	return encodeElement(ident, content), nil
+}
+
+// convertElement reads a single element from b, returning its identifier
+// octets, its DER encoded content and the data that follows it.
+func convertElement(b []byte, depth int) (ident, content, rest []byte, err error) {
+	if depth > maxDepth {
+		return nil, nil, nil, errors.New("cms: BER data nested too deeply")
+	}
+	if len(b) == 0 {
+		return nil, nil, nil, errTruncated
+	}
+
+	// identifier octets, including any high tag number form
+	n := 1
+	if b[0]&0x1f == 0x1f {
+		for ; n < len(b) && b[n]&0x80 != 0; n++ {
+		}
+		n++
+	}
+	if n >= len(b) {
+		return nil, nil, nil, errTruncated
+	}
+	ident, b = b[:n], b[n:]
+	constructed := ident[0]&0x20 != 0
+
+	// length octets
+	var (
+		length     int
+		indefinite bool
+	)
+	switch l := b[0]; {
+	case l == 0x80:
+		indefinite = true
+		b = b[1:]
+	case l < 0x80:
+		length = int(l)
+		b = b[1:]
+	default:
+		ln := int(l & 0x7f)
+		if ln > 4 || ln >= len(b) {
+			return nil, nil, nil, errors.New("cms: invalid BER length")
+		}
+		for _, c := range b[1 : 1+ln] {
+			length = length<<8 | int(c)
+		}
+		b = b[1+ln:]
+	}
+
+	if !constructed {
+		if indefinite {
+			return nil, nil, nil, errors.New("cms: indefinite length primitive element")
+		}
+		if length > len(b) {
+			return nil, nil, nil, errTruncated
+		}
+		return ident, b[:length], b[length:], nil
+	}
+
+	// constructed: convert each child in turn
+	var inner []byte
+	if !indefinite {
+		if length > len(b) {
+			return nil, nil, nil, errTruncated
+		}
+		inner, rest = b[:length], b[length:]
+	} else {
+		inner = b
+	}
+	joinString := ident[0] == 0x24 // constructed universal OCTET STRING
+	for {
+		if indefinite {
+			if len(inner) < 2 {
+				return nil, nil, nil, errTruncated
+			}
+			if inner[0] == 0 && inner[1] == 0 {
+				rest = inner[2:]
+				break
+			}
+		} else if len(inner) == 0 {
+			break
+		}
+		cident, ccontent, crest, err := convertElement(inner, depth+1)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if joinString {
+			content = append(content, ccontent...)
+		} else {
+			content = append(content, encodeElement(cident, ccontent)...)
+		}
+		inner = crest
+	}
+	if joinString {
+		ident = []byte{0x04}
+	}
+	return ident, content, rest, nil
+}
+
+// encodeElement returns the DER encoding of an element with the given
+// identifier octets and content.
+func encodeElement(ident, content []byte) []byte {
+	out := append([]byte{}, ident...)
+	if n := len(content); n < 0x80 {
+		out = append(out, byte(n))
+	} else {
+		var l []byte
+		for ; n > 0; n >>= 8 {
+			l = append([]byte{byte(n)}, l...)
+		}
+		out = append(out, 0x80|byte(len(l)))
+		out = append(out, l...)
+	}
+	return append(out, content...)
+}
@@ -0,0 +1,332 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+// Package cms parses and verifies the signatures of CMS (PKCS #7) SignedData
+// structures as defined by RFC 5652, as used by S/MIME and code signing.
+//
+// Only signature verification is provided; the signers' certificates must be
+// verified separately, for example using rootcerts.Verify.
+package cms
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Object identifiers used by SignedData.
+var (
+	OIDData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	OIDSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+
+	OIDAttributeContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	OIDAttributeMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	OIDAttributeSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	OIDDigestSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	OIDDigestSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	OIDDigestSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	OIDEncryptionRSA      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	OIDSignatureSHA256RSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	OIDSignatureSHA384RSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	OIDSignatureSHA512RSA = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	OIDPublicKeyECDSA     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	OIDSignatureECDSA256  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	OIDSignatureECDSA384  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	OIDSignatureECDSA512  = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	OIDSignatureEd25519   = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// digestAlgorithms maps digest algorithm identifiers to their hash.
+var digestAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+}{
+	{OIDDigestSHA256, crypto.SHA256},
+	{OIDDigestSHA384, crypto.SHA384},
+	{OIDDigestSHA512, crypto.SHA512},
+}
+
+// signatureAlgorithms maps signature algorithm identifiers, along with the
+// hash they are used with, to the equivalent x509.SignatureAlgorithm.  A
+// zero hash matches any digest algorithm.
+var signatureAlgorithms = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+	alg  x509.SignatureAlgorithm
+}{
+	{OIDEncryptionRSA, crypto.SHA256, x509.SHA256WithRSA},
+	{OIDEncryptionRSA, crypto.SHA384, x509.SHA384WithRSA},
+	{OIDEncryptionRSA, crypto.SHA512, x509.SHA512WithRSA},
+	{OIDSignatureSHA256RSA, crypto.SHA256, x509.SHA256WithRSA},
+	{OIDSignatureSHA384RSA, crypto.SHA384, x509.SHA384WithRSA},
+	{OIDSignatureSHA512RSA, crypto.SHA512, x509.SHA512WithRSA},
+	{OIDPublicKeyECDSA, crypto.SHA256, x509.ECDSAWithSHA256},
+	{OIDPublicKeyECDSA, crypto.SHA384, x509.ECDSAWithSHA384},
+	{OIDPublicKeyECDSA, crypto.SHA512, x509.ECDSAWithSHA512},
+	{OIDSignatureECDSA256, crypto.SHA256, x509.ECDSAWithSHA256},
+	{OIDSignatureECDSA384, crypto.SHA384, x509.ECDSAWithSHA384},
+	{OIDSignatureECDSA512, crypto.SHA512, x509.ECDSAWithSHA512},
+	{OIDSignatureEd25519, 0, x509.PureEd25519},
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,tag:0"` // holds the explicitly tagged content
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// SignedData holds a parsed SignedData structure.
+type SignedData struct {
+	ContentType  asn1.ObjectIdentifier
+	Content      []byte // the encapsulated content; nil for a detached signature
+	Certificates []*x509.Certificate
+
+	signers []signerInfo
+}
+
+// A Signer describes a signer whose signature has been verified.
+type Signer struct {
+	Certificate *x509.Certificate
+	SigningTime time.Time // zero if the signer did not include one
+}
+
+// Parse parses a DER or BER encoded ContentInfo holding SignedData.  PEM
+// input, with a PKCS7 or CMS block, is also accepted.
+func Parse(data []byte) (*SignedData, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+	der, err := berToDER(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var ci contentInfo
+	if rest, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, fmt.Errorf("cms: failed to parse content info: %s", err)
+	} else if len(rest) > 0 {
+		return nil, errors.New("cms: trailing data after content info")
+	}
+	if !ci.ContentType.Equal(OIDSignedData) {
+		return nil, fmt.Errorf("cms: content type %s is not signed data", ci.ContentType)
+	}
+
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("cms: failed to parse signed data: %s", err)
+	}
+	result := &SignedData{
+		ContentType: sd.EncapContentInfo.EContentType,
+		Content:     sd.EncapContentInfo.EContent,
+		signers:     sd.SignerInfos,
+	}
+	if len(sd.Certificates.Bytes) > 0 {
+		if result.Certificates, err = x509.ParseCertificates(sd.Certificates.Bytes); err != nil {
+			return nil, fmt.Errorf("cms: failed to parse certificates: %s", err)
+		}
+	}
+	return result, nil
+}
+
+// Verify checks the signature of every signer over content, or over the
+// encapsulated content if content is nil, and returns the signers.  Each
+// signer's certificate is looked up in sd.Certificates or extra.  The
+// certificates themselves are not verified.
+func (sd *SignedData) Verify(content []byte, extra []*x509.Certificate) ([]Signer, error) {
+	switch {
+	case content == nil && sd.Content == nil:
+		return nil, errors.New("cms: detached signature requires content")
+	case content == nil:
+		content = sd.Content
+	case sd.Content != nil && !bytes.Equal(content, sd.Content):
+		return nil, errors.New("cms: content does not match the encapsulated content")
+	}
+	if len(sd.signers) == 0 {
+		return nil, errors.New("cms: no signers")
+	}
+
+	certs := append(append([]*x509.Certificate{}, sd.Certificates...), extra...)
+	var signers []Signer
+	for i, si := range sd.signers {
+		signer, err := sd.verifySigner(si, content, certs)
+		if err != nil {
+			return nil, fmt.Errorf("cms: signer %d: %s", i, err)
+		}
+		signers = append(signers, signer)
+	}
+	return signers, nil
+}
+
+func (sd *SignedData) verifySigner(si signerInfo, content []byte, certs []*x509.Certificate) (Signer, error) {
+	var signer Signer
+	cert, err := findCertificate(si.SID, certs)
+	if err != nil {
+		return signer, err
+	}
+	signer.Certificate = cert
+
+	hash, err := digestHash(si.DigestAlgorithm.Algorithm)
+	if err != nil {
+		return signer, err
+	}
+	alg, err := signatureAlgorithm(si.SignatureAlgorithm.Algorithm, hash)
+	if err != nil {
+		return signer, err
+	}
+
+	signed := content
+	if len(si.SignedAttrs.FullBytes) > 0 {
+		if signer.SigningTime, err = checkSignedAttrs(si.SignedAttrs.Bytes, sd.ContentType, hash, content); err != nil {
+			return signer, err
+		}
+		// the signature covers the DER encoding of the attributes as a SET
+		signed = append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	} else if !sd.ContentType.Equal(OIDData) {
+		return signer, errors.New("signed attributes are required for content types other than data")
+	}
+
+	if err := cert.CheckSignature(alg, signed, si.Signature); err != nil {
+		return signer, fmt.Errorf("invalid signature: %s", err)
+	}
+	return signer, nil
+}
+
+// findCertificate returns the certificate identified by sid.
+func findCertificate(sid asn1.RawValue, certs []*x509.Certificate) (*x509.Certificate, error) {
+	switch {
+	case sid.Class == asn1.ClassUniversal && sid.Tag == asn1.TagSequence:
+		var ias issuerAndSerial
+		if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil {
+			return nil, fmt.Errorf("invalid signer identifier: %s", err)
+		}
+		for _, cert := range certs {
+			if cert.SerialNumber.Cmp(ias.Serial) == 0 && bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) {
+				return cert, nil
+			}
+		}
+	case sid.Class == asn1.ClassContextSpecific && sid.Tag == 0:
+		for _, cert := range certs {
+			if len(cert.SubjectKeyId) > 0 && bytes.Equal(cert.SubjectKeyId, sid.Bytes) {
+				return cert, nil
+			}
+		}
+	default:
+		return nil, errors.New("invalid signer identifier")
+	}
+	return nil, errors.New("signer certificate not found")
+}
+
+// checkSignedAttrs checks the content type and message digest attributes
+// against the content and returns the signing time, if present.
+func checkSignedAttrs(attrs []byte, contentType asn1.ObjectIdentifier, hash crypto.Hash, content []byte) (signingTime time.Time, err error) {
+	var foundType, foundDigest bool
+	for len(attrs) > 0 {
+		var attr attribute
+		if attrs, err = asn1.Unmarshal(attrs, &attr); err != nil {
+			return signingTime, fmt.Errorf("invalid signed attribute: %s", err)
+		}
+		switch {
+		case attr.Type.Equal(OIDAttributeContentType):
+			var oid asn1.ObjectIdentifier
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &oid); err != nil {
+				return signingTime, fmt.Errorf("invalid content type attribute: %s", err)
+			}
+			if !oid.Equal(contentType) {
+				return signingTime, fmt.Errorf("content type attribute %s does not match %s", oid, contentType)
+			}
+			foundType = true
+
+		case attr.Type.Equal(OIDAttributeMessageDigest):
+			var digest []byte
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &digest); err != nil {
+				return signingTime, fmt.Errorf("invalid message digest attribute: %s", err)
+			}
+			h := hash.New()
+			h.Write(content)
+			if !bytes.Equal(digest, h.Sum(nil)) {
+				return signingTime, errors.New("message digest does not match the content")
+			}
+			foundDigest = true
+
+		case attr.Type.Equal(OIDAttributeSigningTime):
+			if _, err := asn1.Unmarshal(attr.Values.Bytes, &signingTime); err != nil {
+				return signingTime, fmt.Errorf("invalid signing time attribute: %s", err)
+			}
+		}
+	}
+	if !foundType || !foundDigest {
+		return signingTime, errors.New("content type and message digest attributes are required")
+	}
+	return signingTime, nil
+}
+
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	for _, d := range digestAlgorithms {
+		if d.oid.Equal(oid) {
+			return d.hash, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported digest algorithm %s", oid)
+}
+
+// DigestOID returns the identifier of the digest algorithm hash.
+func DigestOID(hash crypto.Hash) (asn1.ObjectIdentifier, error) {
+	for _, d := range digestAlgorithms {
+		if d.hash == hash {
+			return d.oid, nil
+		}
+	}
+	return nil, fmt.Errorf("cms: unsupported digest algorithm %s", hash)
+}
+
+func signatureAlgorithm(oid asn1.ObjectIdentifier, hash crypto.Hash) (x509.SignatureAlgorithm, error) {
+	for _, s := range signatureAlgorithms {
+		if s.oid.Equal(oid) && (s.hash == hash || s.hash == 0) {
+			return s.alg, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported signature algorithm %s with %s", oid, hash)
+}
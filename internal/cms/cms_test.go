@@ -0,0 +1,158 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package cms_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts/internal/cms"
+	"github.com/gwatts/rootcerts/internal/cms/cmstest"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+func TestVerify(t *testing.T) {
+	ca := testpki.Issue(t, testpki.CATemplate("Test CA"), nil)
+	ecSigner := testpki.Issue(t, testpki.LeafTemplate("EC Signer", x509.ExtKeyUsageEmailProtection), ca)
+	rsaSigner := testpki.IssueRSA(t, testpki.LeafTemplate("RSA Signer", x509.ExtKeyUsageEmailProtection), ca)
+	content := []byte("signed content\r\n")
+	signingTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		signer *testpki.KeyPair
+		opts   cmstest.Options
+	}{
+		{"ecdsa attached", ecSigner, cmstest.Options{}},
+		{"ecdsa detached", ecSigner, cmstest.Options{Detached: true}},
+		{"rsa attached", rsaSigner, cmstest.Options{}},
+		{"rsa detached", rsaSigner, cmstest.Options{Detached: true}},
+		{"no signed attributes", ecSigner, cmstest.Options{NoSignedAttrs: true}},
+		{"subject key id", rsaSigner, cmstest.Options{SubjectKeyID: true}},
+		{"signing time", ecSigner, cmstest.Options{SigningTime: signingTime}},
+	}
+	for _, test := range tests {
+		sd, err := cms.Parse(cmstest.Sign(t, content, test.signer, test.opts))
+		if err != nil {
+			t.Errorf("%s: Unexpected parse error: %s", test.name, err)
+			continue
+		}
+		if test.opts.Detached != (sd.Content == nil) {
+			t.Errorf("%s: Incorrect content %q", test.name, sd.Content)
+		}
+		var signers []cms.Signer
+		if test.opts.Detached {
+			signers, err = sd.Verify(content, nil)
+		} else {
+			signers, err = sd.Verify(nil, nil)
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", test.name, err)
+			continue
+		}
+		if len(signers) != 1 || !signers[0].Certificate.Equal(test.signer.Cert) {
+			t.Errorf("%s: Incorrect signers %v", test.name, signers)
+			continue
+		}
+		if !signers[0].SigningTime.Equal(test.opts.SigningTime) {
+			t.Errorf("%s: Incorrect signing time %s", test.name, signers[0].SigningTime)
+		}
+
+		if _, err := sd.Verify([]byte("tampered content\r\n"), nil); err == nil {
+			t.Errorf("%s: Tampered content was accepted", test.name)
+		}
+	}
+}
+
+func TestVerifyErrors(t *testing.T) {
+	ca := testpki.Issue(t, testpki.CATemplate("Test CA"), nil)
+	signer := testpki.Issue(t, testpki.LeafTemplate("Signer"), ca)
+	other := testpki.Issue(t, testpki.LeafTemplate("Signer"), ca)
+	content := []byte("content")
+
+	sd, err := cms.Parse(cmstest.Sign(t, content, signer, cmstest.Options{Detached: true}))
+	if err != nil {
+		t.Fatal("Unexpected parse error", err)
+	}
+	if _, err := sd.Verify(nil, nil); err == nil {
+		t.Error("Detached signature verified without content")
+	}
+
+	// a different certificate with the same issuer and subject must not be
+	// mistaken for the signer's
+	sd.Certificates = nil
+	if _, err := sd.Verify(content, []*x509.Certificate{other.Cert}); err == nil {
+		t.Error("Verified using the wrong certificate")
+	}
+	if _, err := sd.Verify(content, []*x509.Certificate{signer.Cert}); err != nil {
+		t.Error("Failed to verify using extra certificate", err)
+	}
+
+	for _, data := range [][]byte{nil, {0x30}, {0x30, 0x03, 0x06, 0x01, 0x00}, signer.Cert.Raw} {
+		if _, err := cms.Parse(data); err == nil {
+			t.Errorf("Parsed invalid data %x", data)
+		}
+	}
+}
+
+func TestParseBER(t *testing.T) {
+	ca := testpki.Issue(t, testpki.CATemplate("Test CA"), nil)
+	signer := testpki.Issue(t, testpki.LeafTemplate("Signer"), ca)
+	content := bytes.Repeat([]byte("0123456789"), 50)
+	der := cmstest.Sign(t, content, signer, cmstest.Options{})
+
+	sd, err := cms.Parse(toBER(t, der))
+	if err != nil {
+		t.Fatal("Failed to parse BER", err)
+	}
+	if !bytes.Equal(sd.Content, content) {
+		t.Fatal("Content was not reassembled")
+	}
+	if _, err := sd.Verify(nil, nil); err != nil {
+		t.Error("Unexpected error", err)
+	}
+}
+
+// toBER re-encodes DER using indefinite lengths for every constructed
+// element and splits OCTET STRINGs into constructed chunks, as a streaming
+// encoder would.
+func toBER(t *testing.T, der []byte) []byte {
+	var out []byte
+	for len(der) > 0 {
+		ident, hdr := der[0], 2
+		length := int(der[1])
+		if der[1] >= 0x80 {
+			n := int(der[1] & 0x7f)
+			length = 0
+			for _, c := range der[2 : 2+n] {
+				length = length<<8 | int(c)
+			}
+			hdr += n
+		}
+		content := der[hdr : hdr+length]
+		switch {
+		case ident == 0x04 && len(content) > 100:
+			// split large OCTET STRINGs into chunks of 100
+			out = append(out, 0x24, 0x80)
+			for len(content) > 0 {
+				n := min(len(content), 100)
+				out = append(out, 0x04, byte(n))
+				out = append(out, content[:n]...)
+				content = content[n:]
+			}
+			out = append(out, 0, 0)
+		case ident&0x20 != 0:
+			out = append(out, ident, 0x80)
+			out = append(out, toBER(t, content)...)
+			out = append(out, 0, 0)
+		default:
+			out = append(out, der[:hdr+length]...)
+		}
+		der = der[hdr+length:]
+	}
+	return out
+}
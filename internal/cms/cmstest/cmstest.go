@@ -0,0 +1,170 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+// Package cmstest creates CMS signed data for use in tests of the packages
+// built on package cms.  Signers are created with package testpki.
+package cmstest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts/internal/cms"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+// Options controls the SignedData created by Sign.
+type Options struct {
+	Detached      bool                // omit the content
+	NoSignedAttrs bool                // sign the content directly
+	SubjectKeyID  bool                // identify the signer by subject key identifier
+	SigningTime   time.Time           // included as a signed attribute if set
+	Certificates  []*x509.Certificate // included after the signer's certificate
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue
+	SignerInfos      []asn1.RawValue `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// Sign returns a DER encoded ContentInfo holding SignedData for content,
+// signed by signer using SHA-256.
+func Sign(tb testing.TB, content []byte, signer *testpki.KeyPair, opts Options) []byte {
+	tb.Helper()
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: cms.OIDDigestSHA256, Parameters: asn1.NullRawValue}
+	sum := sha256.Sum256(content)
+
+	si := signerInfo{
+		Version:         1,
+		DigestAlgorithm: digestAlg,
+	}
+	if opts.SubjectKeyID {
+		si.Version = 3
+		si.SID = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: signer.Cert.SubjectKeyId}
+	} else {
+		si.SID = asn1.RawValue{FullBytes: mustMarshal(tb, issuerAndSerial{
+			Issuer: asn1.RawValue{FullBytes: signer.Cert.RawIssuer},
+			Serial: signer.Cert.SerialNumber,
+		})}
+	}
+
+	signed := content
+	if !opts.NoSignedAttrs {
+		attrs := []attribute{
+			newAttribute(tb, cms.OIDAttributeContentType, cms.OIDData),
+			newAttribute(tb, cms.OIDAttributeMessageDigest, sum[:]),
+		}
+		if !opts.SigningTime.IsZero() {
+			attrs = append(attrs, newAttribute(tb, cms.OIDAttributeSigningTime, opts.SigningTime.UTC()))
+		}
+		// the signature covers the attributes encoded as a SET; they are
+		// stored with an implicit [0] tag instead
+		signed = mustMarshal(tb, struct {
+			Attrs []attribute `asn1:"set"`
+		}{attrs})
+		signed = signed[2+lengthOctets(signed[1]):]
+		tagged := append([]byte{0xa0}, signed[1:]...)
+		si.SignedAttrs = asn1.RawValue{FullBytes: tagged}
+	}
+
+	digest := sha256.Sum256(signed)
+	sig, err := signer.Key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		tb.Fatal("Failed to sign", err)
+	}
+	si.Signature = sig
+	switch signer.Key.(type) {
+	case *rsa.PrivateKey:
+		si.SignatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: cms.OIDEncryptionRSA, Parameters: asn1.NullRawValue}
+	case *ecdsa.PrivateKey:
+		si.SignatureAlgorithm = pkix.AlgorithmIdentifier{Algorithm: cms.OIDSignatureECDSA256}
+	default:
+		tb.Fatalf("Unsupported key type %T", signer.Key)
+	}
+
+	var certs []byte
+	for _, cert := range append([]*x509.Certificate{signer.Cert}, opts.Certificates...) {
+		certs = append(certs, cert.Raw...)
+	}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		EncapContentInfo: encapContentInfo{EContentType: cms.OIDData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos:      []asn1.RawValue{{FullBytes: mustMarshal(tb, si)}},
+	}
+	if opts.SubjectKeyID {
+		sd.Version = 3
+	}
+	if !opts.Detached {
+		sd.EncapContentInfo.EContent = content
+	}
+	return mustMarshal(tb, contentInfo{
+		ContentType: cms.OIDSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: mustMarshal(tb, sd)},
+	})
+}
+
+func newAttribute(tb testing.TB, oid asn1.ObjectIdentifier, value interface{}) attribute {
+	tb.Helper()
+	return attribute{Type: oid, Values: []asn1.RawValue{{FullBytes: mustMarshal(tb, value)}}}
+}
+
+// lengthOctets returns the number of length octets following the first.
+func lengthOctets(b byte) int {
+	if b < 0x80 {
+		return 0
+	}
+	return int(b & 0x7f)
+}
+
+func mustMarshal(tb testing.TB, v interface{}) []byte {
+	tb.Helper()
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		tb.Fatal("Failed to marshal", err)
+	}
+	return der
+}
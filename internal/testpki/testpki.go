@@ -0,0 +1,168 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+// Package testpki creates keys and certificates for use in tests, either as a
+// ready made root, intermediate and leaf or one certificate at a time.
+package testpki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// KeyPair holds a certificate and its private key.
+type KeyPair struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+var serial int64
+
+// Issue creates a certificate from tmpl with a new P-256 key, signed by
+// parent, or self-signed if parent is nil.  The serial number and, if unset,
+// the validity period and subject key identifier of tmpl are filled in.
+func Issue(tb testing.TB, tmpl *x509.Certificate, parent *KeyPair) *KeyPair {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal("Failed to generate key", err)
+	}
+	return issue(tb, tmpl, parent, key)
+}
+
+// IssueRSA is like Issue but creates a 2048 bit RSA key.
+func IssueRSA(tb testing.TB, tmpl *x509.Certificate, parent *KeyPair) *KeyPair {
+	tb.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		tb.Fatal("Failed to generate key", err)
+	}
+	return issue(tb, tmpl, parent, key)
+}
+
+// IssueWithKey is like Issue but certifies an existing key, such as to
+// cross-sign a CA with a second issuer.
+func IssueWithKey(tb testing.TB, tmpl *x509.Certificate, parent *KeyPair, key crypto.Signer) *KeyPair {
+	tb.Helper()
+	return issue(tb, tmpl, parent, key)
+}
+
+func issue(tb testing.TB, tmpl *x509.Certificate, parent *KeyPair, key crypto.Signer) *KeyPair {
+	tb.Helper()
+	tmpl.SerialNumber = big.NewInt(atomic.AddInt64(&serial, 1))
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	if tmpl.SubjectKeyId == nil {
+		// Go only generates subject key identifiers for CAs
+		spki, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			tb.Fatal("Failed to marshal public key", err)
+		}
+		sum := sha1.Sum(spki)
+		tmpl.SubjectKeyId = sum[:]
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, key.Public(), signerKey)
+	if err != nil {
+		tb.Fatal("Failed to create certificate", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal("Failed to parse certificate", err)
+	}
+	return &KeyPair{Cert: cert, Key: key}
+}
+
+// CATemplate returns a template for a CA certificate.
+func CATemplate(cn string) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+}
+
+// LeafTemplate returns a template for an end entity certificate with the
+// given extended key usages.
+func LeafTemplate(cn string, usages ...x509.ExtKeyUsage) *x509.Certificate {
+	return &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: usages,
+	}
+}
+
+// ServerTemplate returns a template for a TLS server certificate for the
+// given DNS names.
+func ServerTemplate(cn string, dnsNames ...string) *x509.Certificate {
+	tmpl := LeafTemplate(cn, x509.ExtKeyUsageServerAuth)
+	tmpl.DNSNames = dnsNames
+	return tmpl
+}
+
+// PKI is a root, an intermediate issued by the root and a leaf issued by the
+// intermediate.
+type PKI struct {
+	Root         *KeyPair
+	Intermediate *KeyPair
+	Leaf         *KeyPair
+}
+
+// New returns a PKI with a root named "Test Root", an intermediate named
+// "Test Intermediate" and a TLS server certificate for example.com.
+func New(tb testing.TB) *PKI {
+	tb.Helper()
+	return NewWithTemplates(tb, nil, nil)
+}
+
+// NewWithTemplates is like New but creates the root and leaf from rootTmpl
+// and leafTmpl unless they are nil.
+func NewWithTemplates(tb testing.TB, rootTmpl, leafTmpl *x509.Certificate) *PKI {
+	tb.Helper()
+	if rootTmpl == nil {
+		rootTmpl = CATemplate("Test Root")
+	}
+	if leafTmpl == nil {
+		leafTmpl = ServerTemplate("example.com", "example.com")
+	}
+	p := &PKI{Root: Issue(tb, rootTmpl, nil)}
+	p.Intermediate = Issue(tb, CATemplate("Test Intermediate"), p.Root)
+	p.Leaf = Issue(tb, leafTmpl, p.Intermediate)
+	return p
+}
+
+// Chain returns the leaf, intermediate and root certificates.
+func (p *PKI) Chain() []*x509.Certificate {
+	return []*x509.Certificate{p.Leaf.Cert, p.Intermediate.Cert, p.Root.Cert}
+}
+
+// Verify verifies leaf using opts with p's root as the only root and
+// intermediates as the intermediates, in place of those in opts.
+func (p *PKI) Verify(leaf *x509.Certificate, intermediates []*x509.Certificate, opts x509.VerifyOptions) ([][]*x509.Certificate, error) {
+	opts.Roots = x509.NewCertPool()
+	opts.Roots.AddCert(p.Root.Cert)
+	opts.Intermediates = x509.NewCertPool()
+	for _, cert := range intermediates {
+		opts.Intermediates.AddCert(cert)
+	}
+	return leaf.Verify(opts)
+}
@@ -0,0 +1,440 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// Limits on path building, which guard against certificates that issue one
+// another in a loop or a chain file with many cross-signed certificates.
+const (
+	maxPathLength = 10
+	maxPaths      = 32
+)
+
+// Kinds of problem found with a path.
+const (
+	problemMissingIssuer = "missing intermediate"
+	problemUntrustedRoot = "untrusted root"
+	problemPurpose       = "root not trusted for purpose"
+	problemExpired       = "expired"
+	problemNotYetValid   = "not yet valid"
+	problemDistrusted    = "distrusted root"
+	problemKeyUsage      = "wrong extended key usage"
+	problemName          = "name mismatch"
+	problemVerify        = "verification failed"
+)
+
+// anchor is an embedded root certificate.
+type anchor struct {
+	rootcerts.Cert
+	x509 *x509.Certificate
+}
+
+// problem describes why a path fails verification.
+type problem struct {
+	kind   string
+	detail string
+}
+
+// certPath is a path from the leaf towards a root.  anchor is nil if the
+// path doesn't end at an embedded root.
+type certPath struct {
+	certs    []*x509.Certificate
+	anchor   *anchor
+	problems []problem
+}
+
+func (p *certPath) addProblem(kind, format string, a ...interface{}) {
+	p.problems = append(p.problems, problem{kind, fmt.Sprintf(format, a...)})
+}
+
+// inspector builds and checks paths against a set of roots.  The checks made
+// by the inspector explain why a path fails, but only verify decides whether
+// the certificate is valid.
+type inspector struct {
+	roots     []*anchor
+	preloaded []*x509.Certificate // intermediates used along with those supplied
+	purpose   rootcerts.TrustLevel
+	name      string
+	now       time.Time
+	verify    rootcerts.VerifyFunc
+}
+
+func newInspector(roots []rootcerts.Cert) *inspector {
+	in := &inspector{purpose: rootcerts.ServerTrustedDelegator, now: time.Now(), verify: rootcerts.Verify}
+	for _, root := range roots {
+		in.roots = append(in.roots, &anchor{Cert: root, x509: root.X509Cert()})
+	}
+	return in
+}
+
+func (in *inspector) anchorFor(cert *x509.Certificate) *anchor {
+	for _, root := range in.roots {
+		if root.x509.Equal(cert) {
+			return root
+		}
+	}
+	return nil
+}
+
+// buildPaths returns every path from leaf that uses the certificates in pool
+// as intermediates and ends at an embedded root, a self-signed certificate
+// or a certificate whose issuer can't be found.
+func (in *inspector) buildPaths(leaf *x509.Certificate, pool []*x509.Certificate) []*certPath {
+	var paths []*certPath
+	var walk func(certs []*x509.Certificate)
+	walk = func(certs []*x509.Certificate) {
+		if len(paths) >= maxPaths {
+			return
+		}
+		cert := certs[len(certs)-1]
+		if a := in.anchorFor(cert); a != nil {
+			paths = append(paths, &certPath{certs: certs, anchor: a})
+			return
+		}
+
+		var issuers []*x509.Certificate
+		for _, root := range in.roots {
+			if issues(root.x509, cert) {
+				issuers = append(issuers, root.x509)
+			}
+		}
+		for _, candidate := range pool {
+			if issues(candidate, cert) && !contains(certs, candidate) && !contains(issuers, candidate) {
+				issuers = append(issuers, candidate)
+			}
+		}
+		if len(issuers) == 0 || len(certs) >= maxPathLength {
+			paths = append(paths, &certPath{certs: certs})
+			return
+		}
+		for _, issuer := range issuers {
+			walk(append(certs[:len(certs):len(certs)], issuer))
+		}
+	}
+	walk([]*x509.Certificate{leaf})
+	return paths
+}
+
+// issues reports whether cert was signed by issuer.
+func issues(issuer, cert *x509.Certificate) bool {
+	if !bytes.Equal(issuer.RawSubject, cert.RawIssuer) || issuer.Equal(cert) {
+		return false
+	}
+	if len(cert.AuthorityKeyId) > 0 && len(issuer.SubjectKeyId) > 0 &&
+		!bytes.Equal(cert.AuthorityKeyId, issuer.SubjectKeyId) {
+		return false
+	}
+	return cert.CheckSignatureFrom(issuer) == nil
+}
+
+func contains(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if c.Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+// check records the problems found with p.
+func (in *inspector) check(p *certPath) {
+	last := p.certs[len(p.certs)-1]
+	switch {
+	case p.anchor == nil && bytes.Equal(last.RawSubject, last.RawIssuer) && last.CheckSignatureFrom(last) == nil:
+		p.addProblem(problemUntrustedRoot, "%s is self-signed but is not an embedded root", certName(last))
+	case p.anchor == nil:
+		detail := fmt.Sprintf("no certificate was found for the issuer of %s, %s", certName(last), last.Issuer)
+		if len(last.IssuingCertificateURL) > 0 {
+			detail += fmt.Sprintf(" (it may be downloaded from %s)", strings.Join(last.IssuingCertificateURL, ", "))
+		}
+		p.addProblem(problemMissingIssuer, "%s", detail)
+	case p.anchor.Trust&in.purpose == 0:
+		p.addProblem(problemPurpose, "root %q is trusted for %s but not %s", p.anchor.Label,
+			purposeName(p.anchor.Trust), purposeName(in.purpose))
+	}
+
+	for i, cert := range p.certs {
+		role := certRole(p, i)
+		switch {
+		case in.now.After(cert.NotAfter):
+			p.addProblem(problemExpired, "%s %s expired on %s", role, certName(cert), formatTime(cert.NotAfter))
+		case in.now.Before(cert.NotBefore):
+			p.addProblem(problemNotYetValid, "%s %s is not valid until %s", role, certName(cert), formatTime(cert.NotBefore))
+		}
+		if usage, ok := in.purpose.KeyUsage(); ok && !permitsUsage(cert, usage) {
+			p.addProblem(problemKeyUsage, "%s %s does not permit %s", role, certName(cert), usageNames[usage])
+		}
+	}
+
+	leaf := p.certs[0]
+	if p.anchor != nil {
+		if distrustAfter := p.anchor.DistrustAfter(in.purpose); !distrustAfter.IsZero() && leaf.NotBefore.After(distrustAfter) {
+			p.addProblem(problemDistrusted, "root %q is distrusted for certificates issued after %s, but the leaf was issued %s",
+				p.anchor.Label, formatTime(distrustAfter), formatTime(leaf.NotBefore))
+		}
+	}
+
+	if in.name != "" {
+		if err := leaf.VerifyHostname(in.name); err != nil {
+			p.addProblem(problemName, "%s", err)
+		} else if p.anchor != nil && !p.anchor.PermitsDNSName(in.name) {
+			p.addProblem(problemName, "root %q may only issue certificates for %s", p.anchor.Label,
+				strings.Join(p.anchor.PermittedDNSDomains, ", "))
+		}
+	}
+
+	// anything else, such as a path length constraint or a blocklist, is
+	// left to Verify
+	if len(p.problems) == 0 {
+		if err := in.verifyPath(p); err != nil {
+			p.addProblem(problemVerify, "%s", err)
+		}
+	}
+}
+
+// verifyPath verifies the leaf of p using only the intermediates in the path.
+func (in *inspector) verifyPath(p *certPath) error {
+	_, err := in.verify(p.certs[0], p.certs[1:len(p.certs)-1], in.verifyOptions())
+	return err
+}
+
+// verifyOptions returns the options to verify with.
+func (in *inspector) verifyOptions() rootcerts.VerifyOptions {
+	return rootcerts.VerifyOptions{Trust: in.purpose, DNSName: in.name, CurrentTime: in.now}
+}
+
+var usageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageServerAuth:      "server authentication",
+	x509.ExtKeyUsageEmailProtection: "email protection",
+	x509.ExtKeyUsageCodeSigning:     "code signing",
+}
+
+// permitsUsage reports whether cert allows usage.  A certificate without
+// extended key usages permits any usage.
+func permitsUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func purposeName(t rootcerts.TrustLevel) string {
+	if s := certparse.TrustLevel(t).String(); s != "" {
+		return s
+	}
+	return "no purpose"
+}
+
+// certRole describes the position of the i'th certificate in p.
+func certRole(p *certPath, i int) string {
+	switch {
+	case i == 0:
+		return "leaf"
+	case i == len(p.certs)-1 && p.anchor != nil:
+		return "root"
+	}
+	return "intermediate"
+}
+
+func certName(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return fmt.Sprintf("%q", cert.Subject.CommonName)
+	}
+	return fmt.Sprintf("%q", cert.Subject.String())
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05 MST")
+}
+
+// report writes the paths built for leaf to w and returns true if any of
+// them verifies.
+func (in *inspector) report(w io.Writer, certs []*x509.Certificate) bool {
+	leaf := certs[0]
+	fmt.Fprintf(w, "Certificate: %s\n", leaf.Subject)
+	fmt.Fprintf(w, "  Issuer:    %s\n", leaf.Issuer)
+	fmt.Fprintf(w, "  Validity:  %s to %s\n", formatTime(leaf.NotBefore), formatTime(leaf.NotAfter))
+	if len(leaf.DNSNames) > 0 {
+		fmt.Fprintf(w, "  DNS names: %s\n", strings.Join(leaf.DNSNames, ", "))
+	}
+	fmt.Fprintf(w, "  SHA256:    %s\n", fingerprint(leaf))
+	fmt.Fprintf(w, "Checking for %s", purposeName(in.purpose))
+	if in.name != "" {
+		fmt.Fprintf(w, " use by %s", in.name)
+	}
+	fmt.Fprintf(w, " at %s\n", formatTime(in.now))
+
+	pool := append(certs[1:len(certs):len(certs)], in.preloaded...)
+	paths := in.buildPaths(leaf, pool)
+	used := make(map[*x509.Certificate]bool)
+	for i, p := range paths {
+		in.check(p)
+		status := "OK"
+		if len(p.problems) > 0 {
+			status = "FAILED"
+		}
+		fmt.Fprintf(w, "\nPath %d: %s\n", i+1, status)
+		for j, cert := range p.certs {
+			used[cert] = true
+			note := ""
+			if j == len(p.certs)-1 && p.anchor != nil {
+				note = fmt.Sprintf("  [embedded root %q, trusted for %s]", p.anchor.Label, purposeName(p.anchor.Trust))
+			} else if j > 0 && !contains(certs, cert) && contains(in.preloaded, cert) {
+				note = "  [preloaded intermediate]"
+			}
+			fmt.Fprintf(w, "  %d %s, expires %s%s\n", j, certName(cert), cert.NotAfter.UTC().Format("2006-01-02"), note)
+		}
+		for _, prob := range p.problems {
+			fmt.Fprintf(w, "  - %s: %s\n", prob.kind, prob.detail)
+		}
+	}
+
+	for i, cert := range certs[1:] {
+		if !used[cert] {
+			fmt.Fprintf(w, "\nNote: certificate %d in the file, %s, is not part of any path\n", i+2, certName(cert))
+		}
+	}
+
+	// the verdict is Verify's, whichever paths the checks above explain
+	result, err := in.verify(leaf, pool, in.verifyOptions())
+	if err != nil {
+		fmt.Fprintf(w, "\nResult: the certificate does not verify against the embedded roots: %s\n", err)
+		return false
+	}
+	fmt.Fprintf(w, "\nResult: the certificate verifies against embedded root %q\n", result.Anchor.Label)
+	return true
+}
+
+// readChain reads PEM encoded certificates, or a single DER certificate, from
+// path, or stdin if path is "-".
+func readChain(path string) ([]*x509.Certificate, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseChain(data)
+}
+
+func parseChain(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	block, rest := pem.Decode(data)
+	if block == nil {
+		var err error
+		if certs, err = x509.ParseCertificates(data); err != nil {
+			return nil, err
+		}
+	}
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("certificate %d: %s", len(certs)+1, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+	return certs, nil
+}
+
+// parseTime accepts an RFC 3339 time or a date.
+func parseTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// runChain implements the chain command.
+func runChain(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("chain", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: rootcerts-inspect chain [flags] <chain.pem>")
+		fmt.Fprintln(stderr, "\nExplains how the first certificate in the file, using the others as intermediates,")
+		fmt.Fprintln(stderr, "verifies against the embedded roots.  Use - to read from stdin.")
+		fmt.Fprintln(stderr, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	name := fs.String("name", "", "DNS name the certificate must be valid for")
+	purpose := fs.String("purpose", "server", "Purpose to verify for: server, email or code")
+	at := fs.String("time", "", "Verify at this time (RFC 3339 or YYYY-MM-DD) instead of now")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	in := newInspector(rootcerts.Certs())
+	for _, c := range rootcerts.Intermediates() {
+		in.preloaded = append(in.preloaded, c.X509Cert())
+	}
+	in.name = *name
+	trust, err := certparse.ParseTrustLevel(*purpose)
+	if _, ok := rootcerts.TrustLevel(trust).KeyUsage(); err != nil || !ok {
+		fmt.Fprintf(stderr, "rootcerts-inspect: invalid purpose %q; use server, email or code\n", *purpose)
+		return 2
+	}
+	in.purpose = rootcerts.TrustLevel(trust)
+	if *at != "" {
+		if in.now, err = parseTime(*at); err != nil {
+			fmt.Fprintf(stderr, "rootcerts-inspect: invalid time %q\n", *at)
+			return 2
+		}
+	}
+
+	certs, err := readChain(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(stderr, "rootcerts-inspect: failed to read %s: %s\n", fs.Arg(0), err)
+		return 2
+	}
+	if !in.report(stdout, certs) {
+		return 1
+	}
+	return 0
+}
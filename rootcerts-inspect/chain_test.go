@@ -0,0 +1,250 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+// testRoot returns the test PKI's root with the given trust.
+func testRoot(pki *testpki.PKI, trust rootcerts.TrustLevel) rootcerts.Cert {
+	return rootcerts.Cert{Label: "Test Root", Trust: trust, DER: pki.Root.Cert.Raw}
+}
+
+// testInspector returns an inspector that verifies against roots, which
+// rootcerts.Verify cannot as they are not embedded.
+func testInspector(roots []rootcerts.Cert) *inspector {
+	in := newInspector(roots)
+	in.verify = func(leaf *x509.Certificate, intermediates []*x509.Certificate, opts rootcerts.VerifyOptions) (*rootcerts.VerifyResult, error) {
+		xopts := x509.VerifyOptions{
+			Roots:         x509.NewCertPool(),
+			Intermediates: x509.NewCertPool(),
+			DNSName:       opts.DNSName,
+			CurrentTime:   opts.CurrentTime,
+		}
+		if usage, ok := opts.Trust.KeyUsage(); ok {
+			xopts.KeyUsages = []x509.ExtKeyUsage{usage}
+		}
+		for _, root := range in.roots {
+			if root.Trust == opts.Trust {
+				xopts.Roots.AddCert(root.x509)
+			}
+		}
+		for _, cert := range intermediates {
+			xopts.Intermediates.AddCert(cert)
+		}
+		chains, err := leaf.Verify(xopts)
+		if err != nil {
+			return nil, err
+		}
+		chain := chains[0]
+		return &rootcerts.VerifyResult{Chain: chain, Anchor: in.anchorFor(chain[len(chain)-1]).Cert}, nil
+	}
+	return in
+}
+
+func problemKinds(paths []*certPath) [][]string {
+	var kinds [][]string
+	for _, p := range paths {
+		var k []string
+		for _, prob := range p.problems {
+			k = append(k, prob.kind)
+		}
+		kinds = append(kinds, k)
+	}
+	return kinds
+}
+
+func TestCheckPaths(t *testing.T) {
+	pki := testpki.New(t)
+	trusted := testRoot(pki, rootcerts.ServerTrustedDelegator)
+
+	expiredTmpl := testpki.CATemplate("Test Root")
+	expiredTmpl.NotBefore = time.Now().Add(-48 * time.Hour)
+	expiredTmpl.NotAfter = time.Now().Add(-time.Hour)
+	expired := testpki.NewWithTemplates(t, expiredTmpl, nil)
+
+	emailLeaf := testpki.LeafTemplate("alice", x509.ExtKeyUsageEmailProtection)
+	wrongEKU := testpki.NewWithTemplates(t, nil, emailLeaf)
+
+	aiaLeaf := testpki.ServerTemplate("example.com", "example.com")
+	aiaLeaf.IssuingCertificateURL = []string{"http://ca.example.net/intermediate.crt"}
+	aia := testpki.NewWithTemplates(t, nil, aiaLeaf)
+
+	distrusted := testRoot(pki, rootcerts.ServerTrustedDelegator)
+	distrusted.ServerDistrustAfter = pki.Leaf.Cert.NotBefore.Add(-time.Hour)
+
+	constrained := testRoot(pki, rootcerts.ServerTrustedDelegator)
+	constrained.PermittedDNSDomains = []string{"tr"}
+
+	tests := []struct {
+		name    string
+		roots   []rootcerts.Cert
+		certs   []*x509.Certificate
+		dnsName string
+		kinds   [][]string
+	}{
+		{"valid", []rootcerts.Cert{trusted}, []*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert}, "example.com",
+			[][]string{nil}},
+		{"missing intermediate", []rootcerts.Cert{trusted}, []*x509.Certificate{pki.Leaf.Cert}, "",
+			[][]string{{problemMissingIssuer}}},
+		{"untrusted root", nil, []*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert, pki.Root.Cert}, "",
+			[][]string{{problemUntrustedRoot}}},
+		{"not trusted for purpose", []rootcerts.Cert{testRoot(pki, rootcerts.EmailTrustedDelegator)},
+			[]*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert}, "",
+			[][]string{{problemPurpose}}},
+		{"expired root", []rootcerts.Cert{testRoot(expired, rootcerts.ServerTrustedDelegator)},
+			[]*x509.Certificate{expired.Leaf.Cert, expired.Intermediate.Cert}, "",
+			[][]string{{problemExpired}}},
+		{"distrusted root", []rootcerts.Cert{distrusted}, []*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert}, "",
+			[][]string{{problemDistrusted}}},
+		{"wrong key usage", []rootcerts.Cert{testRoot(wrongEKU, rootcerts.ServerTrustedDelegator)},
+			[]*x509.Certificate{wrongEKU.Leaf.Cert, wrongEKU.Intermediate.Cert}, "",
+			[][]string{{problemKeyUsage}}},
+		{"name mismatch", []rootcerts.Cert{trusted}, []*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert}, "example.org",
+			[][]string{{problemName}}},
+		{"name constraint", []rootcerts.Cert{constrained}, []*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert}, "example.com",
+			[][]string{{problemName}}},
+		{"unused certificate", []rootcerts.Cert{trusted}, []*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert, aia.Intermediate.Cert}, "",
+			[][]string{nil}},
+	}
+	for _, test := range tests {
+		in := testInspector(test.roots)
+		in.name = test.dnsName
+		paths := in.buildPaths(test.certs[0], test.certs[1:])
+		for _, p := range paths {
+			in.check(p)
+		}
+		if kinds := problemKinds(paths); !equalKinds(kinds, test.kinds) {
+			t.Errorf("%s: Incorrect problems %q", test.name, kinds)
+		}
+	}
+
+	// the missing intermediate's download location is reported
+	in := testInspector([]rootcerts.Cert{testRoot(aia, rootcerts.ServerTrustedDelegator)})
+	var buf bytes.Buffer
+	if in.report(&buf, []*x509.Certificate{aia.Leaf.Cert}) {
+		t.Error("Chain without intermediate verified")
+	}
+	if !strings.Contains(buf.String(), "http://ca.example.net/intermediate.crt") {
+		t.Errorf("Report does not include the issuer URL:\n%s", buf.String())
+	}
+}
+
+func equalKinds(a, b [][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if strings.Join(a[i], ",") != strings.Join(b[i], ",") {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuildPathsMultiple(t *testing.T) {
+	// the intermediate is trusted through either of two roots, one of which
+	// is not embedded
+	pki := testpki.New(t)
+	other := testpki.Issue(t, testpki.CATemplate("Test Root"), nil)
+	cross := testpki.IssueWithKey(t, testpki.CATemplate("Test Intermediate"), other, pki.Intermediate.Key)
+
+	in := testInspector([]rootcerts.Cert{testRoot(pki, rootcerts.ServerTrustedDelegator)})
+	var buf bytes.Buffer
+	ok := in.report(&buf, []*x509.Certificate{pki.Leaf.Cert, cross.Cert, other.Cert, pki.Intermediate.Cert})
+	if !ok {
+		t.Errorf("Chain did not verify:\n%s", buf.String())
+	}
+	for _, want := range []string{"Path 1: FAILED", "untrusted root", "Path 2: OK", `verifies against embedded root "Test Root"`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Report does not include %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestReportPreloaded(t *testing.T) {
+	pki := testpki.New(t)
+	in := testInspector([]rootcerts.Cert{testRoot(pki, rootcerts.ServerTrustedDelegator)})
+	in.preloaded = []*x509.Certificate{pki.Intermediate.Cert}
+	var buf bytes.Buffer
+	if !in.report(&buf, []*x509.Certificate{pki.Leaf.Cert}) {
+		t.Errorf("Chain did not verify:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "[preloaded intermediate]") {
+		t.Errorf("Report does not note the preloaded intermediate:\n%s", buf.String())
+	}
+}
+
+func TestReportVerdict(t *testing.T) {
+	// the checks find nothing wrong, but Verify has the final say
+	pki := testpki.New(t)
+	in := testInspector([]rootcerts.Cert{testRoot(pki, rootcerts.ServerTrustedDelegator)})
+	in.verify = func(leaf *x509.Certificate, intermediates []*x509.Certificate, opts rootcerts.VerifyOptions) (*rootcerts.VerifyResult, error) {
+		return nil, errors.New("root is blocklisted")
+	}
+	var buf bytes.Buffer
+	if in.report(&buf, []*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert}) {
+		t.Errorf("Chain verified:\n%s", buf.String())
+	}
+	for _, want := range []string{"Path 1: FAILED", "does not verify against the embedded roots: root is blocklisted"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Report does not include %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRunChain(t *testing.T) {
+	pki := testpki.New(t)
+	var chain []byte
+	for _, cert := range []*x509.Certificate{pki.Leaf.Cert, pki.Intermediate.Cert} {
+		chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	fn := filepath.Join(t.TempDir(), "chain.pem")
+	if err := os.WriteFile(fn, chain, 0644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(t.TempDir(), "empty.pem")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args   []string
+		status int
+		output string
+	}{
+		{[]string{"chain", "-name", "example.com", fn}, 1, problemMissingIssuer},
+		{[]string{"chain", "-purpose", "email", fn}, 1, "Checking for email"},
+		{[]string{"chain", "-purpose", "bogus", fn}, 2, "invalid purpose"},
+		{[]string{"chain", "-time", "yesterday", fn}, 2, "invalid time"},
+		{[]string{"chain", filepath.Join(t.TempDir(), "missing.pem")}, 2, "failed to read"},
+		{[]string{"chain", empty}, 2, "no certificates found"},
+		{[]string{"chain"}, 2, "Usage"},
+		{[]string{"bogus"}, 2, "unknown command"},
+		{nil, 2, "Commands:"},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		status := run(test.args, &stdout, &stderr)
+		if status != test.status {
+			t.Errorf("%q: Incorrect status %d", test.args, status)
+		}
+		if out := stdout.String() + stderr.String(); !strings.Contains(out, test.output) {
+			t.Errorf("%q: Output does not include %q:\n%s", test.args, test.output, out)
+		}
+	}
+}
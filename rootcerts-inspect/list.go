@@ -0,0 +1,228 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/certparse"
+)
+
+// listedCert is a root certificate read from the embedded roots or a source
+// file.
+type listedCert struct {
+	certparse.Cert
+	PermittedDNSDomains []string
+}
+
+// embeddedCerts returns the roots compiled into the rootcerts package.
+func embeddedCerts() []listedCert {
+	var certs []listedCert
+	for _, c := range rootcerts.Certs() {
+		certs = append(certs, listedCert{
+			Cert: certparse.Cert{
+				Label:               c.Label,
+				Data:                c.DER,
+				Trust:               certparse.TrustLevel(c.Trust),
+				Cert:                c.X509Cert(),
+				ServerDistrustAfter: c.ServerDistrustAfter,
+				EmailDistrustAfter:  c.EmailDistrustAfter,
+			},
+			PermittedDNSDomains: c.PermittedDNSDomains,
+		})
+	}
+	return certs
+}
+
+// readSource reads the roots from path in the given format.  trust is
+// assigned to pem and der sources, which carry no trust information.
+func readSource(path, format string, trust certparse.TrustLevel) ([]listedCert, error) {
+	var (
+		f   io.ReadCloser = os.Stdin
+		err error
+	)
+	if format != certparse.FormatDER && path != "-" {
+		if f, err = os.Open(path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	parsed, err := certparse.ReadSource(format, f, path, trust)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]listedCert, len(parsed))
+	for i, c := range parsed {
+		certs[i].Cert = c
+	}
+	return certs, nil
+}
+
+// certFilter selects the certificates to list.  Zero values match any
+// certificate.
+type certFilter struct {
+	trust         certparse.TrustLevel // any of these purposes
+	keyType       string               // a key type, or its prefix such as rsa
+	expiresBefore time.Time
+	expiresAfter  time.Time
+	label         *regexp.Regexp
+}
+
+func (f *certFilter) match(c listedCert) bool {
+	switch {
+	case f.trust != 0 && c.Trust&f.trust == 0:
+		return false
+	case f.keyType != "" && !matchKeyType(certparse.KeyType(c.Cert.Cert), f.keyType):
+		return false
+	case !f.expiresBefore.IsZero() && !c.Cert.Cert.NotAfter.Before(f.expiresBefore):
+		return false
+	case !f.expiresAfter.IsZero() && !c.Cert.Cert.NotAfter.After(f.expiresAfter):
+		return false
+	case f.label != nil && !f.label.MatchString(c.Label):
+		return false
+	}
+	return true
+}
+
+// matchKeyType reports whether kt, such as rsa-4096, is the type want or has
+// it as its algorithm.
+func matchKeyType(kt, want string) bool {
+	want = strings.ToLower(want)
+	return kt == want || strings.HasPrefix(kt, want+"-")
+}
+
+// writeTable writes one line for each certificate.
+func writeTable(w io.Writer, certs []listedCert) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LABEL\tTRUST\tKEY\tEXPIRES\tSHA256")
+	for _, c := range certs {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", c.Label, c.Trust, certparse.KeyType(c.Cert.Cert),
+			c.Cert.Cert.NotAfter.UTC().Format("2006-01-02"), c.Fingerprint())
+	}
+	return tw.Flush()
+}
+
+// writePEM writes the certificates as a PEM bundle, as gencerts does.
+func writePEM(w io.Writer, certs []listedCert) error {
+	parsed := make([]certparse.Cert, len(certs))
+	for i, c := range certs {
+		parsed[i] = c.Cert
+	}
+	return certparse.WritePEM(w, parsed)
+}
+
+// writeJSON writes the certificates as an inventory in the form written by
+// gencerts.
+func writeJSON(w io.Writer, certs []listedCert) error {
+	var inv certparse.Inventory
+	for _, c := range certs {
+		inv.Certificates = append(inv.Certificates, certparse.NewInventoryCert(c.Cert, c.PermittedDNSDomains))
+	}
+	return certparse.WriteInventory(w, inv)
+}
+
+var listFormats = map[string]func(io.Writer, []listedCert) error{
+	"table": writeTable,
+	"pem":   writePEM,
+	"json":  writeJSON,
+}
+
+// runList implements the list command.
+func runList(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: rootcerts-inspect list [flags]")
+		fmt.Fprintln(stderr, "\nLists the embedded roots, or those read from -source, that match every filter.")
+		fmt.Fprintln(stderr, "\nFlags:")
+		fs.PrintDefaults()
+	}
+	source := fs.String("source", "", "Read roots from this file (or directory for der) instead of the embedded roots.  Use - for stdin")
+	sourceFmt := fs.String("source-format", certparse.FormatCertdata, "Format of -source: certdata, pem, der (a directory of files) or ccadb (CCADB CSV report)")
+	sourceTrust := fs.String("source-trust", "server", "Comma separated trust purposes (server, email, code) to assign to pem and der sources")
+	purpose := fs.String("purpose", "", "Only list roots trusted for any of these comma separated purposes (server, email, code)")
+	keyTypeFlag := fs.String("key-type", "", "Only list roots with this key type, eg. rsa, rsa-4096, ecdsa, ecdsa-p384 or ed25519")
+	expiresBefore := fs.String("expires-before", "", "Only list roots that expire before this time (RFC 3339 or YYYY-MM-DD)")
+	expiresAfter := fs.String("expires-after", "", "Only list roots that expire after this time (RFC 3339 or YYYY-MM-DD)")
+	label := fs.String("label", "", "Only list roots whose label matches this regular expression; prefix with (?i) to ignore case")
+	format := fs.String("format", "table", "Output format: table, pem or json")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	fail := func(format string, a ...interface{}) int {
+		fmt.Fprintf(stderr, "rootcerts-inspect: "+format+"\n", a...)
+		return 2
+	}
+	write, ok := listFormats[*format]
+	if !ok {
+		return fail("unknown format %q", *format)
+	}
+	var (
+		filter certFilter
+		err    error
+	)
+	if *purpose != "" {
+		if filter.trust, err = certparse.ParseTrustLevel(*purpose); err != nil {
+			return fail("invalid purpose: %s", err)
+		}
+	}
+	filter.keyType = *keyTypeFlag
+	if *expiresBefore != "" {
+		if filter.expiresBefore, err = parseTime(*expiresBefore); err != nil {
+			return fail("invalid time %q", *expiresBefore)
+		}
+	}
+	if *expiresAfter != "" {
+		if filter.expiresAfter, err = parseTime(*expiresAfter); err != nil {
+			return fail("invalid time %q", *expiresAfter)
+		}
+	}
+	if *label != "" {
+		if filter.label, err = regexp.Compile(*label); err != nil {
+			return fail("invalid label pattern: %s", err)
+		}
+	}
+
+	certs := embeddedCerts()
+	if *source != "" {
+		trust, err := certparse.ParseTrustLevel(*sourceTrust)
+		if err != nil {
+			return fail("invalid source trust: %s", err)
+		}
+		if certs, err = readSource(*source, *sourceFmt, trust); err != nil {
+			return fail("failed to read %s: %s", *source, err)
+		}
+	}
+
+	var matched []listedCert
+	for _, c := range certs {
+		if filter.match(c) {
+			matched = append(matched, c)
+		}
+	}
+	if err := write(stdout, matched); err != nil {
+		return fail("failed to write output: %s", err)
+	}
+	if len(matched) == 0 {
+		return 1
+	}
+	return 0
+}
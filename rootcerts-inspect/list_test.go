@@ -0,0 +1,113 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/certparse"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+// writeTestRoots writes a PEM bundle holding an ECDSA root expiring in a day
+// and an RSA root expiring in ten years.
+func writeTestRoots(t *testing.T) string {
+	ecTmpl := testpki.CATemplate("Example EC Root")
+	rsaTmpl := testpki.CATemplate("Example RSA Root")
+	rsaTmpl.NotAfter = time.Now().AddDate(10, 0, 0)
+	var bundle []byte
+	for _, kp := range []*testpki.KeyPair{testpki.Issue(t, ecTmpl, nil), testpki.IssueRSA(t, rsaTmpl, nil)} {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kp.Cert.Raw})...)
+	}
+	fn := filepath.Join(t.TempDir(), "roots.pem")
+	if err := os.WriteFile(fn, bundle, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+func TestRunList(t *testing.T) {
+	fn := writeTestRoots(t)
+	nextYear := time.Now().AddDate(1, 0, 0).Format("2006-01-02")
+
+	tests := []struct {
+		args   []string
+		status int
+		labels []string
+	}{
+		{nil, 0, []string{"Example EC Root", "Example RSA Root"}},
+		{[]string{"-key-type", "ecdsa"}, 0, []string{"Example EC Root"}},
+		{[]string{"-key-type", "rsa-2048"}, 0, []string{"Example RSA Root"}},
+		{[]string{"-key-type", "rsa-4096"}, 1, nil},
+		{[]string{"-expires-before", nextYear}, 0, []string{"Example EC Root"}},
+		{[]string{"-expires-after", nextYear}, 0, []string{"Example RSA Root"}},
+		{[]string{"-label", "(?i)example rsa"}, 0, []string{"Example RSA Root"}},
+		{[]string{"-purpose", "email"}, 1, nil},
+		{[]string{"-source-trust", "server,email", "-purpose", "email,code"}, 0, []string{"Example EC Root", "Example RSA Root"}},
+	}
+	for _, test := range tests {
+		args := append([]string{"list", "-source", fn, "-source-format", "pem", "-format", "json"}, test.args...)
+		var stdout, stderr bytes.Buffer
+		if status := run(args, &stdout, &stderr); status != test.status {
+			t.Errorf("%q: Incorrect status %d: %s", test.args, status, stderr.String())
+			continue
+		}
+		var inv certparse.Inventory
+		if err := json.Unmarshal(stdout.Bytes(), &inv); err != nil {
+			t.Errorf("%q: Invalid JSON: %s", test.args, err)
+			continue
+		}
+		var labels []string
+		for _, c := range inv.Certificates {
+			labels = append(labels, c.Label)
+		}
+		if strings.Join(labels, ",") != strings.Join(test.labels, ",") {
+			t.Errorf("%q: Incorrect certificates %q", test.args, labels)
+		}
+	}
+}
+
+func TestRunListFormats(t *testing.T) {
+	fn := writeTestRoots(t)
+	var stdout, stderr bytes.Buffer
+	if status := run([]string{"list", "-source", fn, "-source-format", "pem", "-format", "pem"}, &stdout, &stderr); status != 0 {
+		t.Fatalf("Incorrect status %d: %s", status, stderr.String())
+	}
+	// the bundle may be read back in the same way as gencerts output
+	certs, err := certparse.ReadPEMCerts(&stdout, certparse.ServerTrustedDelegator)
+	if err != nil || len(certs) != 2 || certs[0].Label != "Example EC Root" {
+		t.Errorf("Incorrect PEM output (err=%v)", err)
+	}
+
+	stdout.Reset()
+	if status := run([]string{"list", "-purpose", "server"}, &stdout, &stderr); status != 0 {
+		t.Fatalf("Incorrect status %d: %s", status, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if !strings.HasPrefix(lines[0], "LABEL") || len(lines)-1 != len(rootcerts.CertsByTrust(rootcerts.ServerTrustedDelegator)) {
+		t.Errorf("Incorrect table of %d lines", len(lines))
+	}
+
+	for _, args := range [][]string{
+		{"list", "-format", "xml"},
+		{"list", "-purpose", "bogus"},
+		{"list", "-label", "("},
+		{"list", "-expires-before", "soon"},
+		{"list", "-source", fn, "-source-format", "bogus"},
+		{"list", "extra"},
+	} {
+		if status := run(args, &stdout, &stderr); status != 2 {
+			t.Errorf("%q: Incorrect status %d", args, status)
+		}
+	}
+}
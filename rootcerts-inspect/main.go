@@ -0,0 +1,88 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+/*
+Command rootcerts-inspect examines certificates against the root certificates embedded in the
+rootcerts package.
+
+Usage:
+
+	rootcerts-inspect <command> [flags] [arguments]
+
+The chain command reads a PEM file holding a certificate followed by any intermediates, such as
+a server's certificate chain, and builds every path from the certificate to the embedded roots,
+also using any intermediates preloaded into the rootcerts package.  Each path is printed along
+with the reasons it fails verification: a missing intermediate, an expired certificate, a root
+that is distrusted or not trusted for the purpose, a certificate that doesn't permit the required
+extended key usage or a name that the certificate doesn't match.  The result is that of
+rootcerts.Verify, so it also applies the blocklist and any other policy of the package; the exit
+status is 0 if the chain verifies and 1 otherwise:
+
+	rootcerts-inspect chain -name example.com chain.pem
+
+The list command lists the roots embedded in the rootcerts package that rootcerts-inspect was
+built with, or those read from a certdata.txt, PEM, DER or CCADB file using -source and
+-source-format, as with gencerts.  Roots may be filtered by trust purpose, key type, expiry and
+a regular expression matched against their labels, and are written as a table, a PEM bundle or
+a JSON inventory like that of gencerts.  The exit status is 0 if any root matches and 1 otherwise, so the command can answer
+whether a CA is trusted:
+
+	rootcerts-inspect list -purpose server -label '(?i)isrg'
+	rootcerts-inspect list -key-type rsa-2048 -expires-before 2030-01-01 -format json
+*/
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// command is a subcommand, which returns the exit status.
+type command struct {
+	run     func(args []string, stdout, stderr io.Writer) int
+	summary string
+}
+
+var commands = map[string]command{
+	"chain": {runChain, "explain how a certificate chain verifies against the embedded roots"},
+	"list":  {runList, "list the embedded roots, or those in a file, that match filters"},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: rootcerts-inspect <command> [flags] [arguments]")
+	fmt.Fprintln(w, "\nCommands:")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w, "\nRun rootcerts-inspect <command> -h for the flags of a command.")
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		usage(stderr)
+		return 2
+	}
+	if args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		usage(stdout)
+		return 0
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "rootcerts-inspect: unknown command %q\n\n", args[0])
+		usage(stderr)
+		return 2
+	}
+	return cmd.run(args[1:], stdout, stderr)
+}
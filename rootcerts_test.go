@@ -1,9 +1,21 @@
 package rootcerts
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts/internal/testpki"
 )
 
 // Some tests to make sure the generated .go code is sane.
@@ -91,3 +103,424 @@ func TestUpdateDefaultTransportNilTransport(t *testing.T) {
 		t.Fatal("Didn't get expected error")
 	}
 }
+
+func TestCheckAge(t *testing.T) {
+	day := 24 * time.Hour
+	now := GeneratedAt.Add(10 * day)
+
+	tests := []struct {
+		name    string
+		warnAge time.Duration
+		maxAge  time.Duration
+		err     bool
+		warning bool
+	}{
+		{"fresh", 20 * day, 30 * day, false, false},
+		{"warn", 5 * day, 30 * day, true, true},
+		{"stale", 5 * day, 7 * day, true, false},
+		{"disabled", 0, 0, false, false},
+	}
+	for _, test := range tests {
+		err := checkAge(now, test.warnAge, test.maxAge)
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error result: %v", test.name, err)
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		se, ok := err.(*StaleError)
+		if !ok {
+			t.Fatalf("%s: incorrect error type %T", test.name, err)
+		}
+		if se.Warning != test.warning {
+			t.Errorf("%s: incorrect warning flag %t", test.name, se.Warning)
+		}
+		if se.Age != 10*day {
+			t.Errorf("%s: incorrect age %s", test.name, se.Age)
+		}
+	}
+}
+
+func TestNameConstraints(t *testing.T) {
+	root := testpki.Issue(t, testpki.CATemplate("Constrained Root"), nil)
+	c := Cert{Label: "Constrained Root", DER: root.Cert.Raw, PermittedDNSDomains: []string{"tr"}}
+	pool := x509.NewCertPool()
+	c.addToPool(pool)
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"example.tr", true},
+		{"www.example.com.tr", true},
+		{"WWW.EXAMPLE.TR.", true},
+		{"example.com", false},
+		{"exampletr", false},
+	}
+	for _, test := range tests {
+		leaf := testpki.Issue(t, testpki.ServerTemplate(test.name, test.name), root)
+		_, err := leaf.Cert.Verify(x509.VerifyOptions{Roots: pool})
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("name %q: expected ok=%t, got err=%v", test.name, test.ok, err)
+		}
+		if ok := c.PermitsDNSName(test.name); ok != test.ok {
+			t.Errorf("name %q: PermitsDNSName returned %t", test.name, ok)
+		}
+	}
+}
+
+func TestPurposePolicy(t *testing.T) {
+	server := time.Date(2024, 11, 30, 0, 0, 0, 0, time.UTC)
+	email := server.AddDate(0, 1, 0)
+	c := Cert{ServerDistrustAfter: server, EmailDistrustAfter: email}
+
+	tests := []struct {
+		trust         TrustLevel
+		usage         x509.ExtKeyUsage
+		ok            bool
+		distrustAfter time.Time
+	}{
+		{ServerTrustedDelegator, x509.ExtKeyUsageServerAuth, true, server},
+		{EmailTrustedDelegator, x509.ExtKeyUsageEmailProtection, true, email},
+		{CodeTrustedDelegator, x509.ExtKeyUsageCodeSigning, true, time.Time{}},
+		{ServerTrustedDelegator | EmailTrustedDelegator, 0, false, time.Time{}},
+	}
+	for _, test := range tests {
+		if usage, ok := test.trust.KeyUsage(); usage != test.usage || ok != test.ok {
+			t.Errorf("trust %d: incorrect key usage %v %t", test.trust, usage, ok)
+		}
+		if d := c.DistrustAfter(test.trust); !d.Equal(test.distrustAfter) {
+			t.Errorf("trust %d: incorrect distrust after %s", test.trust, d)
+		}
+	}
+}
+
+func TestDefaultNameConstraints(t *testing.T) {
+	var found bool
+	for _, c := range Certs() {
+		if c.Label == "TUBITAK Kamu SM SSL Kok Sertifikasi - Surum 1" {
+			found = true
+			if len(c.PermittedDNSDomains) != 1 || c.PermittedDNSDomains[0] != "tr" {
+				t.Errorf("Incorrect constraints for %q: %v", c.Label, c.PermittedDNSDomains)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Constrained root not found")
+	}
+}
+
+// testStore returns a store holding root with the given trust, along with
+// an intermediate issued by root.
+func testStore(t *testing.T, trust TrustLevel) (s *store, root, intermediate *testpki.KeyPair) {
+	pki := testpki.New(t)
+	s = newStore([]Cert{{Label: "Test Root", Trust: trust, DER: pki.Root.Cert.Raw}}, nil)
+	return s, pki.Root, pki.Intermediate
+}
+
+func TestVerify(t *testing.T) {
+	s, root, intermediate := testStore(t, ServerTrustedDelegator|EmailTrustedDelegator)
+	leaf := testpki.Issue(t, testpki.ServerTemplate("example.com", "example.com"), intermediate)
+
+	result, err := s.verify(leaf.Cert, []*x509.Certificate{intermediate.Cert}, VerifyOptions{DNSName: "example.com"})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if result.Anchor.Label != "Test Root" {
+		t.Errorf("Incorrect anchor %q", result.Anchor.Label)
+	}
+	if len(result.Chain) != 3 || !result.Chain[2].Equal(root.Cert) {
+		t.Errorf("Incorrect chain length %d", len(result.Chain))
+	}
+
+	tests := []struct {
+		name          string
+		intermediates []*x509.Certificate
+		opts          VerifyOptions
+	}{
+		{"no intermediate", nil, VerifyOptions{}},
+		{"wrong name", []*x509.Certificate{intermediate.Cert}, VerifyOptions{DNSName: "example.org"}},
+		{"wrong purpose", []*x509.Certificate{intermediate.Cert}, VerifyOptions{Trust: EmailTrustedDelegator}},
+		{"multiple purposes", []*x509.Certificate{intermediate.Cert}, VerifyOptions{Trust: ServerTrustedDelegator | EmailTrustedDelegator}},
+		{"expired", []*x509.Certificate{intermediate.Cert}, VerifyOptions{CurrentTime: time.Now().Add(48 * time.Hour)}},
+	}
+	for _, test := range tests {
+		if _, err := s.verify(leaf.Cert, test.intermediates, test.opts); err == nil {
+			t.Errorf("%s: did not receive an error", test.name)
+		}
+	}
+}
+
+func TestVerifyPurpose(t *testing.T) {
+	s, _, intermediate := testStore(t, EmailTrustedDelegator)
+	tmpl := testpki.LeafTemplate("user", x509.ExtKeyUsageEmailProtection)
+	tmpl.EmailAddresses = []string{"user@example.com"}
+	leaf := testpki.Issue(t, tmpl, intermediate)
+	intermediates := []*x509.Certificate{intermediate.Cert}
+
+	if _, err := s.verify(leaf.Cert, intermediates, VerifyOptions{Trust: EmailTrustedDelegator}); err != nil {
+		t.Error("Unexpected error", err)
+	}
+	_, err := s.verify(leaf.Cert, intermediates, VerifyOptions{Trust: ServerTrustedDelegator})
+	if _, ok := err.(x509.UnknownAuthorityError); !ok {
+		t.Errorf("Root not trusted for servers was used: %v", err)
+	}
+}
+
+func TestVerifyPolicy(t *testing.T) {
+	s, _, intermediate := testStore(t, ServerTrustedDelegator)
+	tmpl := testpki.ServerTemplate("example.com", "example.com")
+	tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	leaf := testpki.Issue(t, tmpl, intermediate)
+	intermediates := []*x509.Certificate{intermediate.Cert}
+	checkErr := errors.New("rejected by check")
+
+	tests := []struct {
+		name     string
+		distrust time.Time
+		opts     VerifyOptions
+		err      error
+	}{
+		{"distrusted before issue", leaf.Cert.NotBefore.Add(-time.Minute), VerifyOptions{}, ErrDistrusted},
+		{"distrusted after issue", leaf.Cert.NotBefore.Add(time.Minute), VerifyOptions{}, nil},
+		{"email distrust ignored", time.Time{}, VerifyOptions{}, nil},
+		{"blocklisted", time.Time{}, VerifyOptions{Blocklist: []string{testFingerprint(intermediate.Cert)}}, ErrBlocklisted},
+		{"other blocklisted", time.Time{}, VerifyOptions{Blocklist: []string{strings.Repeat("00", 32)}}, nil},
+		{"check", time.Time{}, VerifyOptions{CheckChain: func([]*x509.Certificate) error { return checkErr }}, checkErr},
+	}
+	for _, test := range tests {
+		s.certs[0].ServerDistrustAfter = test.distrust
+		s.certs[0].EmailDistrustAfter = leaf.Cert.NotBefore.Add(-time.Minute)
+		_, err := s.verify(leaf.Cert, intermediates, test.opts)
+		if test.err == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.name, err)
+			}
+			continue
+		}
+		pe, ok := err.(*PolicyError)
+		if !ok {
+			t.Errorf("%s: incorrect error %T %v", test.name, err, err)
+			continue
+		}
+		if !errors.Is(err, test.err) || pe.Anchor.Label != "Test Root" {
+			t.Errorf("%s: incorrect error %s", test.name, err)
+		}
+	}
+}
+
+func TestVerifyNoAnchor(t *testing.T) {
+	// the pool holds a root that the store has no record of
+	s, _, _ := testStore(t, ServerTrustedDelegator)
+	other, _, intermediate := testStore(t, ServerTrustedDelegator)
+	s.pools[ServerTrustedDelegator] = other.pool(ServerTrustedDelegator)
+
+	leaf := testpki.Issue(t, testpki.ServerTemplate("example.com", "example.com"), intermediate)
+	result, err := s.verify(leaf.Cert, []*x509.Certificate{intermediate.Cert}, VerifyOptions{})
+	if pe, ok := err.(*PolicyError); ok && pe == nil {
+		t.Fatal("Returned a nil *PolicyError as a non-nil error")
+	}
+	if result != nil || err == nil {
+		t.Fatalf("Expected an error, got result=%v err=%v", result, err)
+	}
+}
+
+func TestVerifyEmbedded(t *testing.T) {
+	_, _, intermediate := testStore(t, ServerTrustedDelegator)
+	leaf := testpki.Issue(t, testpki.ServerTemplate("example.com", "example.com"), intermediate)
+	_, err := Verify(leaf.Cert, []*x509.Certificate{intermediate.Cert}, VerifyOptions{})
+	if _, ok := err.(x509.UnknownAuthorityError); !ok {
+		t.Errorf("Test root was trusted: %v", err)
+	}
+}
+
+func testFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// testTLSServer starts a TLS server presenting a certificate for example.com
+// issued by intermediate.
+func testTLSServer(t *testing.T, intermediate *testpki.KeyPair) *httptest.Server {
+	leaf := testpki.Issue(t, testpki.ServerTemplate("example.com", "example.com"), intermediate)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Cert.Raw, intermediate.Cert.Raw},
+		PrivateKey:  leaf.Key,
+	}}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestTLSConfig(t *testing.T) {
+	s, _, intermediate := testStore(t, ServerTrustedDelegator)
+	srv := testTLSServer(t, intermediate)
+
+	tests := []struct {
+		name     string
+		distrust time.Time
+		opts     VerifyOptions
+		insecure bool
+		ok       bool
+	}{
+		{"trusted", time.Time{}, VerifyOptions{}, false, true},
+		{"distrusted", time.Now().Add(-48 * time.Hour), VerifyOptions{}, false, false},
+		{"distrusted insecure", time.Now().Add(-48 * time.Hour), VerifyOptions{}, true, false},
+		{"blocklisted", time.Time{}, VerifyOptions{Blocklist: []string{testFingerprint(intermediate.Cert)}}, false, false},
+		{"wrong name", time.Time{}, VerifyOptions{DNSName: "example.org"}, false, false},
+	}
+	for _, test := range tests {
+		s.certs[0].ServerDistrustAfter = test.distrust
+		config := s.tlsConfig(test.opts)
+		config.ServerName = "example.com"
+		config.InsecureSkipVerify = test.insecure
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: expected ok=%t, got err=%v", test.name, test.ok, err)
+		}
+	}
+}
+
+func TestVerifyPreloaded(t *testing.T) {
+	s, _, intermediate := testStore(t, ServerTrustedDelegator)
+	tmpl := testpki.ServerTemplate("example.com", "example.com")
+	tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	leaf := testpki.Issue(t, tmpl, intermediate)
+	if _, err := s.verify(leaf.Cert, nil, VerifyOptions{}); err == nil {
+		t.Fatal("Verified without the intermediate")
+	}
+
+	s = newStore(s.certs, []Cert{{Label: "Test Intermediate", DER: intermediate.Cert.Raw}})
+	result, err := s.verify(leaf.Cert, nil, VerifyOptions{DNSName: "example.com"})
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if len(result.Chain) != 3 || !result.Chain[1].Equal(intermediate.Cert) {
+		t.Errorf("Incorrect chain length %d", len(result.Chain))
+	}
+	other := testpki.Issue(t, testpki.CATemplate("Other Intermediate"), nil)
+	if _, err := s.verify(leaf.Cert, []*x509.Certificate{other.Cert}, VerifyOptions{}); err != nil {
+		t.Error("Unexpected error with supplied intermediates", err)
+	}
+
+	// the server omits the intermediate
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{
+		Certificate: [][]byte{leaf.Cert.Raw},
+		PrivateKey:  leaf.Key,
+	}}}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+	for _, test := range []struct {
+		name, dnsName string
+		ok            bool
+	}{
+		{"example.com", "", true},
+		{"example.org", "", false},
+		{"", "", false}, // dialing the IP address leaves nothing to check
+		{"", "example.com", true},
+		{"", "127.0.0.1", true},
+		{"", "127.0.0.2", false},
+	} {
+		config := s.tlsConfig(VerifyOptions{DNSName: test.dnsName})
+		config.ServerName = test.name
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%q/%q: expected ok=%t, got err=%v", test.name, test.dnsName, test.ok, err)
+		}
+	}
+
+	// a client that sets no server name at all
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := tls.Client(conn, s.tlsConfig(VerifyOptions{})).Handshake(); err == nil {
+		t.Error("Connection without a server name was accepted")
+	}
+}
+
+func TestVerifyConnectionNoCerts(t *testing.T) {
+	if err := VerifyConnection(VerifyOptions{})(tls.ConnectionState{}); err == nil {
+		t.Error("Connection without certificates was accepted")
+	}
+}
+
+func TestClientAuthConfig(t *testing.T) {
+	s, root, intermediate := testStore(t, EmailTrustedDelegator)
+	untrusted := testpki.Issue(t, testpki.CATemplate("Untrusted Root"), nil)
+	clientAuth := x509.ExtKeyUsageClientAuth
+
+	tests := []struct {
+		name     string
+		auth     tls.ClientAuthType
+		issuer   *testpki.KeyPair // nil to present no certificate
+		usage    x509.ExtKeyUsage
+		distrust bool
+		ok       bool
+	}{
+		{"valid", tls.RequireAndVerifyClientCert, intermediate, clientAuth, false, true},
+		{"issued by root", tls.RequireAndVerifyClientCert, root, clientAuth, false, true},
+		{"missing", tls.RequireAndVerifyClientCert, nil, clientAuth, false, false},
+		{"optional missing", tls.VerifyClientCertIfGiven, nil, clientAuth, false, true},
+		{"optional untrusted", tls.VerifyClientCertIfGiven, untrusted, clientAuth, false, false},
+		{"untrusted", tls.RequireAndVerifyClientCert, untrusted, clientAuth, false, false},
+		{"wrong usage", tls.RequireAndVerifyClientCert, intermediate, x509.ExtKeyUsageServerAuth, false, false},
+		{"distrusted", tls.RequireAndVerifyClientCert, intermediate, clientAuth, true, false},
+	}
+	for _, test := range tests {
+		s.certs[0].EmailDistrustAfter = time.Time{}
+		if test.distrust {
+			s.certs[0].EmailDistrustAfter = time.Now().Add(-48 * time.Hour)
+		}
+
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		srv.TLS = s.clientAuthConfig(test.auth, VerifyOptions{Trust: EmailTrustedDelegator})
+		srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+		srv.StartTLS()
+
+		client := srv.Client()
+		config := client.Transport.(*http.Transport).TLSClientConfig
+		if test.issuer != nil {
+			cert := testpki.Issue(t, testpki.LeafTemplate("client", test.usage), test.issuer)
+			chain := [][]byte{cert.Cert.Raw}
+			if test.issuer == intermediate {
+				chain = append(chain, intermediate.Cert.Raw)
+			}
+			// always present the certificate, even if its issuer was not requested
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &tls.Certificate{Certificate: chain, PrivateKey: cert.Key}, nil
+			}
+		}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		srv.Close()
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("%s: expected ok=%t, got err=%v", test.name, test.ok, err)
+		}
+	}
+}
+
+func TestClientAuthConfigPool(t *testing.T) {
+	config := ClientAuthConfig(tls.RequestClientCert, VerifyOptions{Trust: EmailTrustedDelegator})
+	if config.ClientCAs != CertPool(EmailTrustedDelegator) {
+		t.Error("ClientCAs is not the email trusted pool")
+	}
+	if config.VerifyConnection != nil {
+		t.Error("VerifyConnection set for a client auth type that does not verify")
+	}
+}
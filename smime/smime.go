@@ -0,0 +1,265 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+// Package smime verifies S/MIME signed messages against the roots that
+// Mozilla trusts to issue email certificates.
+//
+// Both detached signatures (multipart/signed) and signatures that enclose the
+// signed content (application/pkcs7-mime) are supported, using RSA or ECDSA
+// keys.  Each signer's certificate is verified with rootcerts.Verify for the
+// EmailTrustedDelegator purpose, which requires the email protection
+// extended key usage.
+package smime
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/internal/cms"
+)
+
+// Options controls the checks made by Verify and VerifyMessage.
+type Options struct {
+	// VerifyOptions is used to verify each signer's certificate.  Its Trust
+	// field is ignored; certificates are always verified for
+	// EmailTrustedDelegator.
+	rootcerts.VerifyOptions
+
+	// Email, if set, must be one of the email addresses in each signer's
+	// certificate.  It is compared without regard to case.
+	Email string
+}
+
+// Signer describes a signer whose signature and certificate were verified.
+type Signer struct {
+	Certificate *x509.Certificate
+	SigningTime time.Time // the signing time claimed by the signer, if any
+	Verified    *rootcerts.VerifyResult
+}
+
+// Result holds the signed content and its signers.
+type Result struct {
+	// Content holds the signed content.  For a message this is the signed
+	// MIME entity, including its headers, with CRLF line endings.
+	Content []byte
+	Signers []Signer
+}
+
+// Verify verifies a DER, BER or PEM encoded PKCS #7 signature.  content holds
+// the signed data for a detached signature and must be nil if the signature
+// encloses its content.  Every signer must have a valid signature and a
+// certificate that chains to a root trusted for email.
+func Verify(p7, content []byte, opts Options) (*Result, error) {
+	return verify(p7, content, opts, rootcerts.Verify)
+}
+
+func verify(p7, content []byte, opts Options, verifyChain rootcerts.VerifyFunc) (*Result, error) {
+	sd, err := cms.Parse(p7)
+	if err != nil {
+		return nil, err
+	}
+	signers, err := sd.Verify(content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	vopts := opts.VerifyOptions
+	vopts.Trust = rootcerts.EmailTrustedDelegator
+	result := &Result{Content: content}
+	if content == nil {
+		result.Content = sd.Content
+	}
+	for _, s := range signers {
+		if opts.Email != "" && !hasEmail(s.Certificate, opts.Email) {
+			return nil, fmt.Errorf("smime: signer certificate %q is not valid for %s",
+				s.Certificate.Subject.CommonName, opts.Email)
+		}
+		var intermediates []*x509.Certificate
+		for _, cert := range sd.Certificates {
+			if !cert.Equal(s.Certificate) {
+				intermediates = append(intermediates, cert)
+			}
+		}
+		verified, err := verifyChain(s.Certificate, intermediates, vopts)
+		if err != nil {
+			return nil, fmt.Errorf("smime: signer certificate %q: %w", s.Certificate.Subject.CommonName, err)
+		}
+		result.Signers = append(result.Signers, Signer{
+			Certificate: s.Certificate,
+			SigningTime: s.SigningTime,
+			Verified:    verified,
+		})
+	}
+	return result, nil
+}
+
+func hasEmail(cert *x509.Certificate, email string) bool {
+	for _, addr := range cert.EmailAddresses {
+		if strings.EqualFold(addr, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyMessage reads an RFC 5322 message and verifies its S/MIME signature.
+// The message must be either multipart/signed or application/pkcs7-mime
+// holding signed data.
+func VerifyMessage(r io.Reader, opts Options) (*Result, error) {
+	return verifyMessage(r, opts, rootcerts.Verify)
+}
+
+func verifyMessage(r io.Reader, opts Options, verifyChain rootcerts.VerifyFunc) (*Result, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("smime: failed to read message: %s", err)
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("smime: failed to read message: %s", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("smime: invalid content type: %s", err)
+	}
+
+	switch mediaType {
+	case "multipart/signed":
+		parts, err := splitMultipart(canonicalize(body), params["boundary"])
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("smime: multipart/signed message has %d parts, expected 2", len(parts))
+		}
+		sig, err := mail.ReadMessage(bytes.NewReader(parts[1]))
+		if err != nil {
+			return nil, fmt.Errorf("smime: failed to read signature part: %s", err)
+		}
+		if !isPKCS7(sig.Header.Get("Content-Type"), "application/pkcs7-signature") {
+			return nil, errors.New("smime: second part of multipart/signed message is not a signature")
+		}
+		p7, err := decodeBody(sig.Header, sig.Body)
+		if err != nil {
+			return nil, err
+		}
+		return verify(p7, parts[0], opts, verifyChain)
+
+	case "application/pkcs7-mime", "application/x-pkcs7-mime":
+		if st := params["smime-type"]; st != "" && !strings.EqualFold(st, "signed-data") {
+			return nil, fmt.Errorf("smime: unsupported smime-type %q", st)
+		}
+		p7, err := decodeBody(msg.Header, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return verify(p7, nil, opts, verifyChain)
+	}
+	return nil, fmt.Errorf("smime: message of type %s is not signed", mediaType)
+}
+
+// isPKCS7 reports whether contentType is mediaType or its x- prefixed form.
+func isPKCS7(contentType, mediaType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mt == mediaType || mt == strings.Replace(mediaType, "/", "/x-", 1)
+}
+
+// decodeBody reads body, decoding its Content-Transfer-Encoding.
+func decodeBody(h mail.Header, body io.Reader) ([]byte, error) {
+	switch enc := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))); enc {
+	case "base64":
+		data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body}))
+		if err != nil {
+			return nil, fmt.Errorf("smime: invalid base64 signature: %s", err)
+		}
+		return data, nil
+	case "", "7bit", "8bit", "binary":
+		return io.ReadAll(body)
+	default:
+		return nil, fmt.Errorf("smime: unsupported transfer encoding %q", enc)
+	}
+}
+
+// newlineStripper removes line breaks and other whitespace from base64 data.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (s *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		j := 0
+		for _, c := range p[:n] {
+			if c != '\r' && c != '\n' && c != ' ' && c != '\t' {
+				p[j] = c
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// canonicalize converts bare LF line endings to CRLF, the canonical form over
+// which S/MIME signatures are computed.
+func canonicalize(b []byte) []byte {
+	var out []byte
+	for i, c := range b {
+		if c == '\n' && (i == 0 || b[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+// splitMultipart returns the raw content of each body part of a multipart
+// body.  mime/multipart can't be used as the signed part must be verified
+// exactly as it appears in the message, headers included.
+func splitMultipart(body []byte, boundary string) ([][]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("smime: multipart message has no boundary")
+	}
+	// a delimiter is a boundary line, along with the line break before it
+	delim := []byte("\r\n--" + boundary)
+	body = append([]byte("\r\n"), body...)
+
+	i := bytes.Index(body, delim)
+	if i < 0 {
+		return nil, errors.New("smime: multipart message has no parts")
+	}
+	var parts [][]byte
+	for {
+		body = body[i+len(delim):]
+		if bytes.HasPrefix(body, []byte("--")) {
+			return parts, nil
+		}
+		// skip any transport padding to the end of the boundary line
+		eol := bytes.Index(body, []byte("\r\n"))
+		if eol < 0 || len(bytes.TrimRight(body[:eol], " \t")) > 0 {
+			return nil, errors.New("smime: invalid multipart boundary line")
+		}
+		body = body[eol+2:]
+		if i = bytes.Index(body, delim); i < 0 {
+			return nil, errors.New("smime: multipart message is truncated")
+		}
+		parts = append(parts, body[:i])
+		// the next search starts at the delimiter ending this part
+		body = body[i:]
+		i = 0
+	}
+}
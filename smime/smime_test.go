@@ -0,0 +1,213 @@
+// Copyright 2015 Gareth Watts
+// Licensed under an MIT license
+// See the LICENSE file for details
+
+package smime
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gwatts/rootcerts"
+	"github.com/gwatts/rootcerts/internal/cms/cmstest"
+	"github.com/gwatts/rootcerts/internal/testpki"
+)
+
+// testSigner issues an RSA or ECDSA certificate for email to sign with.
+func testSigner(t *testing.T, pki *testpki.PKI, email string, rsa bool, usages ...x509.ExtKeyUsage) *testpki.KeyPair {
+	tmpl := testpki.LeafTemplate(email, usages...)
+	tmpl.EmailAddresses = []string{email}
+	if rsa {
+		return testpki.IssueRSA(t, tmpl, pki.Intermediate)
+	}
+	return testpki.Issue(t, tmpl, pki.Intermediate)
+}
+
+// testVerifier returns a rootcerts.VerifyFunc that verifies certificates against
+// the test root in the way that rootcerts.Verify would if the root were
+// trusted for email.
+func testVerifier(pki *testpki.PKI) rootcerts.VerifyFunc {
+	return func(leaf *x509.Certificate, intermediates []*x509.Certificate, opts rootcerts.VerifyOptions) (*rootcerts.VerifyResult, error) {
+		if opts.Trust != rootcerts.EmailTrustedDelegator {
+			return nil, fmt.Errorf("incorrect trust %d", opts.Trust)
+		}
+		chains, err := pki.Verify(leaf, intermediates, x509.VerifyOptions{
+			CurrentTime: opts.CurrentTime,
+			KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &rootcerts.VerifyResult{
+			Chain:  chains[0],
+			Anchor: rootcerts.Cert{Label: "Test Root", Trust: rootcerts.EmailTrustedDelegator, DER: pki.Root.Cert.Raw},
+		}, nil
+	}
+}
+
+func TestVerify(t *testing.T) {
+	pki := testpki.New(t)
+	ecSigner := testSigner(t, pki, "alice@example.com", false, x509.ExtKeyUsageEmailProtection)
+	rsaSigner := testSigner(t, pki, "bob@example.com", true, x509.ExtKeyUsageEmailProtection)
+	serverCert := testSigner(t, pki, "carol@example.com", false, x509.ExtKeyUsageServerAuth)
+	chain := []*x509.Certificate{pki.Intermediate.Cert}
+	content := []byte("Content-Type: text/plain\r\n\r\nHello\r\n")
+
+	tests := []struct {
+		name     string
+		signer   *testpki.KeyPair
+		detached bool
+		certs    []*x509.Certificate
+		opts     Options
+		ok       bool
+	}{
+		{"ecdsa detached", ecSigner, true, chain, Options{}, true},
+		{"ecdsa attached", ecSigner, false, chain, Options{}, true},
+		{"rsa detached", rsaSigner, true, chain, Options{}, true},
+		{"rsa attached", rsaSigner, false, chain, Options{}, true},
+		{"email match", ecSigner, true, chain, Options{Email: "ALICE@example.com"}, true},
+		{"email mismatch", ecSigner, true, chain, Options{Email: "bob@example.com"}, false},
+		{"missing intermediate", ecSigner, true, nil, Options{}, false},
+		{"wrong key usage", serverCert, true, chain, Options{}, false},
+		{"expired", ecSigner, true, chain, Options{VerifyOptions: rootcerts.VerifyOptions{CurrentTime: time.Now().Add(48 * time.Hour)}}, false},
+	}
+	for _, test := range tests {
+		p7 := cmstest.Sign(t, content, test.signer, cmstest.Options{Detached: test.detached, Certificates: test.certs})
+		var detached []byte
+		if test.detached {
+			detached = content
+		}
+		result, err := verify(p7, detached, test.opts, testVerifier(pki))
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: Expected error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(result.Content, content) {
+			t.Errorf("%s: Incorrect content %q", test.name, result.Content)
+		}
+		if len(result.Signers) != 1 || !result.Signers[0].Certificate.Equal(test.signer.Cert) {
+			t.Errorf("%s: Incorrect signers", test.name)
+		} else if result.Signers[0].Verified.Anchor.Label != "Test Root" {
+			t.Errorf("%s: Incorrect anchor %q", test.name, result.Signers[0].Verified.Anchor.Label)
+		}
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	pki := testpki.New(t)
+	signer := testSigner(t, pki, "alice@example.com", false, x509.ExtKeyUsageEmailProtection)
+	p7 := cmstest.Sign(t, []byte("original"), signer, cmstest.Options{Detached: true, Certificates: []*x509.Certificate{pki.Intermediate.Cert}})
+
+	if _, err := verify(p7, []byte("tampered"), Options{}, testVerifier(pki)); err == nil {
+		t.Error("Tampered content was accepted")
+	}
+	// a signature by a key that doesn't match the certificate
+	other := testSigner(t, pki, "alice@example.com", false, x509.ExtKeyUsageEmailProtection)
+	forged := cmstest.Sign(t, []byte("original"), &testpki.KeyPair{Cert: signer.Cert, Key: other.Key}, cmstest.Options{Detached: true})
+	if _, err := verify(forged, []byte("original"), Options{}, testVerifier(pki)); err == nil {
+		t.Error("Forged signature was accepted")
+	}
+}
+
+func TestVerifyEmbedded(t *testing.T) {
+	// a certificate from a private CA must not be trusted by the embedded roots
+	pki := testpki.New(t)
+	signer := testSigner(t, pki, "alice@example.com", false, x509.ExtKeyUsageEmailProtection)
+	p7 := cmstest.Sign(t, []byte("content"), signer, cmstest.Options{Certificates: []*x509.Certificate{pki.Intermediate.Cert}})
+	_, err := Verify(p7, nil, Options{})
+	var uae x509.UnknownAuthorityError
+	if !errors.As(err, &uae) {
+		t.Errorf("Expected unknown authority error, got %v", err)
+	}
+}
+
+// testMultipartSigned returns a multipart/signed message with the given line
+// ending, signing its first part with signer.
+func testMultipartSigned(t *testing.T, signer *testpki.KeyPair, chain []*x509.Certificate, eol string) (msg string, signed []byte) {
+	entity := "Content-Type: text/plain; charset=us-ascii\r\n\r\nHello Bob,\r\n\r\nThe meeting is at noon.\r\n"
+	p7 := cmstest.Sign(t, []byte(entity), signer, cmstest.Options{Detached: true, Certificates: chain})
+	sig := base64.StdEncoding.EncodeToString(p7)
+	var wrapped []string
+	for len(sig) > 64 {
+		wrapped, sig = append(wrapped, sig[:64]), sig[64:]
+	}
+	wrapped = append(wrapped, sig)
+
+	msg = strings.Join([]string{
+		"From: alice@example.com",
+		"To: bob@example.com",
+		"Subject: signed",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/signed; protocol="application/pkcs7-signature"; micalg=sha-256; boundary="----BOUNDARY"`,
+		"",
+		"This is an S/MIME signed message",
+		"",
+		"------BOUNDARY",
+		entity,
+		"------BOUNDARY",
+		`Content-Type: application/pkcs7-signature; name="smime.p7s"`,
+		"Content-Transfer-Encoding: base64",
+		`Content-Disposition: attachment; filename="smime.p7s"`,
+		"",
+		strings.Join(wrapped, "\r\n"),
+		"",
+		"------BOUNDARY--",
+		"",
+	}, "\r\n")
+	return strings.ReplaceAll(msg, "\r\n", eol), []byte(entity)
+}
+
+func TestVerifyMessage(t *testing.T) {
+	pki := testpki.New(t)
+	signer := testSigner(t, pki, "alice@example.com", true, x509.ExtKeyUsageEmailProtection)
+	chain := []*x509.Certificate{pki.Intermediate.Cert}
+
+	for _, eol := range []string{"\r\n", "\n"} {
+		msg, entity := testMultipartSigned(t, signer, chain, eol)
+		result, err := verifyMessage(strings.NewReader(msg), Options{Email: "alice@example.com"}, testVerifier(pki))
+		if err != nil {
+			t.Errorf("eol %q: Unexpected error: %s", eol, err)
+			continue
+		}
+		if !bytes.Equal(result.Content, entity) {
+			t.Errorf("eol %q: Incorrect content %q", eol, result.Content)
+		}
+
+		tampered := strings.Replace(msg, "noon", "midnight", 1)
+		if _, err := verifyMessage(strings.NewReader(tampered), Options{}, testVerifier(pki)); err == nil {
+			t.Errorf("eol %q: Tampered message was accepted", eol)
+		}
+	}
+
+	entity := []byte("Content-Type: text/plain\r\n\r\nEnclosed\r\n")
+	p7 := cmstest.Sign(t, entity, signer, cmstest.Options{Certificates: chain})
+	msg := "From: alice@example.com\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: application/x-pkcs7-mime; smime-type=signed-data; name=smime.p7m\r\n" +
+		"Content-Transfer-Encoding: base64\r\n\r\n" +
+		base64.StdEncoding.EncodeToString(p7) + "\r\n"
+	result, err := verifyMessage(strings.NewReader(msg), Options{}, testVerifier(pki))
+	if err != nil {
+		t.Fatal("Unexpected error", err)
+	}
+	if !bytes.Equal(result.Content, entity) {
+		t.Errorf("Incorrect content %q", result.Content)
+	}
+
+	unsigned := "From: alice@example.com\r\nContent-Type: text/plain\r\n\r\nHello\r\n"
+	if _, err := verifyMessage(strings.NewReader(unsigned), Options{}, testVerifier(pki)); err == nil {
+		t.Error("Unsigned message was accepted")
+	}
+}